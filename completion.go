@@ -0,0 +1,388 @@
+package subcommand
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const BASH_COMPLETION_TEMPLATE = `# bash completion for %[1]v
+%[2]v() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local cmd="" words i
+	for ((i=1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		%[3]v)
+			cmd="${COMP_WORDS[i]}"
+			break
+			;;
+		esac
+	done
+%[7]v	case "$cmd" in
+%[4]v	*)
+		words=%[5]v
+		;;
+	esac
+	COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -F %[2]v %[6]v
+`
+
+const BASH_VALUES_TEMPLATE = `	case "${COMP_WORDS[COMP_CWORD-1]}" in
+	%v)
+		COMPREPLY=($("${COMP_WORDS[0]}" __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}"))
+		return
+		;;
+	esac
+`
+
+//GenerateBashCompletion writes to w a bash completion script for the parser. The script completes
+//the command names and global flags at the top level and the command flags once a command is found.
+//The values of the options with CompleteValues are asked to the program (see COMPLETE_COMMAND).
+//Source it from the shell (source <(prog completion)) or install it in the bash completion directory
+func (p *Parser) GenerateBashCompletion(w io.Writer) error {
+	commands := completionCommands(p)
+	var names []string
+	var cases string
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+		words := flagNames(visibleFlags(cmd.Flags()))
+		if cmd.Name == p.help.Name {
+			words = commandNames(commands, p.help.Name)
+		}
+		cases += fmt.Sprintf("\t%v)\n\t\twords=%v\n\t\t;;\n", shellQuote(cmd.Name), shellQuote(strings.Join(words, " ")))
+	}
+	patterns := make([]string, 0, len(names))
+	for _, name := range names {
+		patterns = append(patterns, shellQuote(name))
+	}
+	topLevel := append(flagNames(visibleFlags(p.Flags())), names...)
+	//the values are asked to the program after the options completing them
+	var values string
+	if options := completedOptions(p); len(options) > 0 {
+		for i, option := range options {
+			options[i] = shellQuote(option)
+		}
+		values = fmt.Sprintf(BASH_VALUES_TEMPLATE, strings.Join(options, "|"))
+	}
+	_, err := fmt.Fprintf(w, BASH_COMPLETION_TEMPLATE, p.Name, completionFunction(p.Name), strings.Join(patterns, "|"),
+		cases, shellQuote(strings.Join(topLevel, " ")), shellQuote(p.Name), values)
+	return err
+}
+
+const ZSH_COMPLETION_TEMPLATE = `#compdef %[1]v
+
+%[2]v() {
+	local curcontext="$curcontext" state line
+	local -a commands
+	commands=(
+%[3]v	)
+	_arguments -C \
+%[4]v		'1: :->command' \
+		'*:: :->args'
+	case $state in
+	command)
+		_describe -t commands %[5]v commands
+		;;
+	args)
+		case $line[1] in
+%[6]v		esac
+		;;
+	esac
+}
+
+%[2]v_values() {
+	local -a values
+	values=(${(f)"$(%[7]v __complete -- "${(@)words[$1,CURRENT]}")"})
+	compadd -a values
+}
+
+%[2]v "$@"
+`
+
+//GenerateZshCompletion writes to w a zsh completion script for the parser in compdef format. The
+//script describes the commands and flags using their short descriptions, the values of the options
+//with CompleteValues are asked to the program. Install it as _prog in a directory of the zsh fpath
+func (p *Parser) GenerateZshCompletion(w io.Writer) error {
+	commands := completionCommands(p)
+	function := "_" + nonIdentifier.ReplaceAllString(p.Name, "_")
+	var descriptions, cases string
+	for _, cmd := range commands {
+		descriptions += fmt.Sprintf("\t\t%v\n", shellQuote(strings.Replace(cmd.Name, ":", `\:`, -1)+":"+cmd.ShortDesc))
+		if cmd.Name == p.help.Name {
+			cases += fmt.Sprintf("\t\t%v)\n\t\t\t_describe -t commands %v commands\n\t\t\t;;\n",
+				shellQuote(cmd.Name), shellQuote(p.Name+" commands"))
+			continue
+		}
+		//the command is the first word within its arguments
+		if specs := zshFlagSpecs(visibleFlags(cmd.Flags()), "\t\t\t\t", function+"_values 1"); specs != "" {
+			cases += fmt.Sprintf("\t\t%v)\n\t\t\t_arguments \\\n%v\t\t\t;;\n", shellQuote(cmd.Name), specs)
+		}
+	}
+	_, err := fmt.Fprintf(w, ZSH_COMPLETION_TEMPLATE, p.Name, function, descriptions,
+		zshFlagSpecs(visibleFlags(p.Flags()), "\t\t", function+"_values 2"), shellQuote(p.Name+" commands"), cases, shellQuote(p.Name))
+	return err
+}
+
+//Builds the _arguments specs for the flags, one per line ending in a line continuation. The values
+//of the options with CompleteValues are completed by the values function
+func zshFlagSpecs(flags []Flag, indent, values string) (specs string) {
+	for _, f := range flags {
+		value := ""
+		if f.Type == Option {
+			value = ":" + zshEscape(strings.ToUpper(f.name())) + ": "
+		}
+		if f.completer != nil {
+			value = ":" + zshEscape(strings.ToUpper(f.name())) + ":{" + values + "}"
+		}
+		for _, name := range flagNames([]Flag{f}) {
+			specs += fmt.Sprintf("%v%v \\\n", indent, shellQuote(name+"["+zshEscape(f.ShortDesc)+"]"+value))
+		}
+	}
+	return
+}
+
+//Escapes the characters with special meaning in zsh completion specs
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+//GenerateFishCompletion writes to w the fish completion lines for the parser, one complete
+//command per command and flag. The values of the options with CompleteValues are asked to the program. Install it as prog.fish in the fish completions directory
+func (p *Parser) GenerateFishCompletion(w io.Writer) error {
+	prog := shellQuote(p.Name)
+	commands := completionCommands(p)
+	lines := []string{fmt.Sprintf("# fish completion for %v", p.Name)}
+	lines = append(lines, fishFlagLines(prog, "__fish_use_subcommand", visibleFlags(p.Flags()))...)
+	for _, cmd := range commands {
+		lines = append(lines, fmt.Sprintf("complete -c %v -n '__fish_use_subcommand' -f -a %v -d %v",
+			prog, shellQuote(cmd.Name), shellQuote(cmd.ShortDesc)))
+	}
+	for _, cmd := range commands {
+		condition := "__fish_seen_subcommand_from " + cmd.Name
+		if cmd.Name == p.help.Name {
+			lines = append(lines, fmt.Sprintf("complete -c %v -n %v -f -a %v",
+				prog, shellQuote(condition), shellQuote(strings.Join(commandNames(commands, p.help.Name), " "))))
+			continue
+		}
+		lines = append(lines, fishFlagLines(prog, condition, visibleFlags(cmd.Flags()))...)
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+//Builds the complete lines for the flags under the given condition. Options require an argument
+func fishFlagLines(prog, condition string, flags []Flag) []string {
+	lines := make([]string, 0, len(flags))
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c %v -n %v", prog, shellQuote(condition))
+		if f.Long != "" {
+			line += " -l " + shellQuote(f.Long)
+		}
+		if utf8.RuneCountInString(f.Short) == 1 {
+			line += " -s " + shellQuote(f.Short)
+		} else if f.Short != "" {
+			line += " -o " + shellQuote(f.Short)
+		}
+		if f.Type == Option {
+			line += " -r"
+		}
+		if f.completer != nil {
+			line += " -f -a " + shellQuote(fmt.Sprintf("(%v __complete -- (commandline -opc)[2..-1] (commandline -ct))", prog))
+		}
+		lines = append(lines, line+" -d "+shellQuote(f.ShortDesc))
+	}
+	return lines
+}
+
+//Returns the names of the visible options with CompleteValues, of the parser and its commands
+func completedOptions(p *Parser) []string {
+	var names []string
+	for _, cmd := range completionCommands(p) {
+		for _, f := range visibleFlags(cmd.Flags()) {
+			if f.completer != nil {
+				names = append(names, flagNames([]Flag{f})...)
+			}
+		}
+	}
+	for _, f := range visibleFlags(p.Flags()) {
+		if f.completer != nil {
+			names = append(names, flagNames([]Flag{f})...)
+		}
+	}
+	return names
+}
+
+//Returns the visible commands of the parser, help included, sorted by name
+func completionCommands(p *Parser) []*Command {
+	commands := make([]*Command, 0, len(p.Commands)+1)
+	for _, cmd := range visibleCommands(p.Commands) {
+		commands = append(commands, cmd)
+	}
+	if !p.noHelp {
+		commands = append(commands, &p.help)
+	}
+	sort.Sort(byName(commands))
+	return commands
+}
+
+//Returns the names of the commands skipping the given one
+func commandNames(commands []*Command, skip string) []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		if cmd.Name != skip {
+			names = append(names, cmd.Name)
+		}
+	}
+	return names
+}
+
+//Returns the flag names as typed in the command line (--long and -s)
+func flagNames(flags []Flag) []string {
+	names := make([]string, 0, 2*len(flags))
+	for _, f := range flags {
+		if f.Long != "" {
+			names = append(names, "--"+f.Long)
+		}
+		if f.Short != "" {
+			names = append(names, "-"+f.Short)
+		}
+	}
+	return names
+}
+
+var nonIdentifier = regexp.MustCompile("[^A-Za-z0-9_]")
+
+//Builds a valid shell function name for the program
+func completionFunction(program string) string {
+	return "_" + nonIdentifier.ReplaceAllString(program, "_") + "_completion"
+}
+
+//Quotes the string so the shell takes it literally
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+//Name of the hidden command printing the completion candidates, one per line, for the words after
+//it (prog __complete -- status --output o). They are the words up to the cursor, there is no cursor
+//position: the last word is the one under the cursor, an empty one after a space. The generated
+//scripts call it to complete the option values (see Flag.CompleteValues). A command added with the
+//same name takes its place
+const COMPLETE_COMMAND = "__complete"
+
+//returns the words to complete if the arguments call the completion command
+func (p *Parser) completeArgs(args []string) ([]string, bool) {
+	if len(args) == 0 || args[0] != COMPLETE_COMMAND {
+		return nil, false
+	}
+	if _, ok := p.Commands[p.key(COMPLETE_COMMAND)]; ok {
+		return nil, false
+	}
+	words := args[1:]
+	if len(words) > 0 && words[0] == "--" {
+		words = words[1:]
+	}
+	return words, true
+}
+
+//writes the completion candidates for the words to the output, one per line
+func (p *Parser) printCompletion(words []string) error {
+	for _, candidate := range p.Complete(words) {
+		if _, err := fmt.Fprintln(p.writer(), candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Complete returns the candidates completing the last of the arguments, the word being typed, given
+//the ones preceding it. They are the commands or the flags starting with it, or the values returned
+//by the CompleteValues function of the option expecting it. No other function is called. The
+//arguments of the commands are not completed, nor the hidden commands and flags
+func (p *Parser) Complete(args []string) []string {
+	word := ""
+	if len(args) > 0 {
+		args, word = args[:len(args)-1], args[len(args)-1]
+	}
+	cmd := &p.Command
+	for i := 0; i < len(args); i++ {
+		arg, isFlag := cmd.flagForm(args[i])
+		if !isFlag {
+			if cmd.Name != p.Command.Name {
+				continue
+			}
+			if next, ok, _ := p.lookupCommand(arg, *cmd); ok {
+				cmd = next
+			} else if p.isHelp(arg) {
+				cmd = &p.help
+			}
+			continue
+		}
+		opt := valueOption(arg, *cmd)
+		if opt == nil {
+			continue
+		}
+		if i+opt.nargs >= len(args) { //the word is one of its values
+			return opt.completeValues("", word)
+		}
+		i += opt.nargs
+	}
+	if strings.HasPrefix(word, "--") && strings.Contains(word, "=") {
+		idx := strings.Index(word, "=")
+		if opt, _ := cmd.lookupLong(word[2:idx]); opt != nil && opt.Type == Option {
+			return opt.completeValues(word[:idx+1], word[idx+1:])
+		}
+		return nil
+	}
+	var candidates []string
+	switch {
+	case strings.HasPrefix(word, "-"):
+		candidates = flagNames(visibleFlags(cmd.AllFlags()))
+	case cmd.Name == p.Command.Name:
+		candidates = commandNames(completionCommands(p), "")
+	case cmd.Name == p.help.Name:
+		candidates = commandNames(completionCommands(p), p.help.Name)
+	}
+	matching := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matching = append(matching, candidate)
+		}
+	}
+	sort.Strings(matching)
+	return matching
+}
+
+//returns the option taking the arguments after the flag as its values, nil for switches, options
+//with the value after = or optional and consumers, as it's unknown how many arguments they take
+func valueOption(arg string, cmd Command) *Flag {
+	var opt *Flag
+	if strings.HasPrefix(arg, "--") {
+		if strings.Contains(arg, "=") {
+			return nil
+		}
+		opt, _ = cmd.lookupLong(arg[2:])
+	} else {
+		opt, _ = cmd.lookupFlag(cmd.key(arg[1:]), false)
+	}
+	if opt == nil || opt.Type != Option || opt.hasOptional || opt.consumer != nil {
+		return nil
+	}
+	return opt
+}
+
+//returns the values of the option completing the prefix, preceded by the given text (--option=)
+func (f Flag) completeValues(before, prefix string) []string {
+	if f.completer == nil {
+		return nil
+	}
+	values := f.completer(prefix)
+	candidates := make([]string, 0, len(values))
+	for _, value := range values {
+		candidates = append(candidates, before+value)
+	}
+	return candidates
+}
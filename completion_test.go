@@ -0,0 +1,182 @@
+package subcommand
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func completionParser() *Parser {
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "Be verbose", emptyFn)
+	parser.AddSwitch("debug", "", "Debug", emptyFn).Hidden(true)
+	cmd := parser.AddCommand("status", "Shows the status", "", emptyFnMult)
+	cmd.AddOption("output", "o", "Output file", "", "", emptyFn)
+	parser.AddCommand("commit", "Commits", "", emptyFnMult)
+	return parser
+}
+
+func TestGenerateBashCompletion(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := completionParser().GenerateBashCompletion(buf); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	for _, expected := range []string{
+		"complete -F _test_completion 'test'",
+		"'commit'|'help'|'status')",
+		"words='--verbose -v commit help status'",
+		"'status')\n\t\twords='--output -o'",
+		"'help')\n\t\twords='commit status'",
+	} {
+		if !strings.Contains(res, expected) {
+			t.Errorf("%q not found in completion script:\n%v", expected, res)
+		}
+	}
+	if strings.Contains(res, "--debug") {
+		t.Error("Hidden flag in completion script")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if res := shellQuote("it's"); res != `'it'\''s'` {
+		t.Errorf("Wrong quoting %v", res)
+	}
+}
+
+func TestGenerateZshCompletion(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := completionParser().GenerateZshCompletion(buf); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	for _, expected := range []string{
+		"#compdef test\n",
+		"'status:Shows the status'",
+		"'--verbose[Be verbose]' \\\n",
+		"'-v[Be verbose]' \\\n",
+		"'status')\n\t\t\t_arguments \\\n\t\t\t\t'--output[Output file]:OUTPUT: ' \\\n",
+		"_test \"$@\"",
+	} {
+		if !strings.Contains(res, expected) {
+			t.Errorf("%q not found in completion script:\n%v", expected, res)
+		}
+	}
+	if strings.Contains(res, "--debug") {
+		t.Error("Hidden flag in completion script")
+	}
+}
+
+func TestZshEscape(t *testing.T) {
+	if res := zshEscape("a:b[c]"); res != `a\:b\[c\]` {
+		t.Errorf("Wrong escaping %v", res)
+	}
+}
+
+func TestGenerateFishCompletion(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := completionParser().GenerateFishCompletion(buf); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	for _, expected := range []string{
+		"complete -c 'test' -n '__fish_use_subcommand' -l 'verbose' -s 'v' -d 'Be verbose'\n",
+		"complete -c 'test' -n '__fish_use_subcommand' -f -a 'status' -d 'Shows the status'\n",
+		"complete -c 'test' -n '__fish_seen_subcommand_from status' -l 'output' -s 'o' -r -d 'Output file'\n",
+		"complete -c 'test' -n '__fish_seen_subcommand_from help' -f -a 'commit status'\n",
+	} {
+		if !strings.Contains(res, expected) {
+			t.Errorf("%q not found in completion script:\n%v", expected, res)
+		}
+	}
+	if strings.Contains(res, "debug") {
+		t.Error("Hidden flag in completion script")
+	}
+}
+
+func TestComplete(t *testing.T) {
+	parser := completionParser()
+	var prefixes []string
+	parser.Commands["status"].innerFlagsLong["output"].CompleteValues(func(prefix string) []string {
+		prefixes = append(prefixes, prefix)
+		return []string{"out.txt", "out.json"}
+	})
+	for args, expected := range map[string]string{
+		"":                         "commit,help,status",
+		"st":                       "status",
+		"-":                        "--verbose,-v",
+		"--v":                      "--verbose",
+		"-v c":                     "commit",
+		"status -":                 "--output,--verbose,-o,-v",
+		"status -o out":            "out.txt,out.json",
+		"status --output ":         "out.txt,out.json",
+		"status --output=o":        "--output=out.txt,--output=out.json",
+		"status --output out.txt ": "",
+		"status --verbose=":        "",
+		"help ":                    "commit,status",
+		"commit x":                 "",
+	} {
+		if res := strings.Join(parser.Complete(strings.Split(args, " ")), ","); res != expected {
+			t.Errorf("Expected %q got %q completing %q", expected, res, args)
+		}
+	}
+	sort.Strings(prefixes)
+	if res := strings.Join(prefixes, ","); res != ",o,out" {
+		t.Errorf("Wrong prefixes passed to the completion function %q", res)
+	}
+	if res := parser.Complete(nil); len(res) != 3 {
+		t.Errorf("No arguments should complete the commands, got %v", res)
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	parser := completionParser()
+	parser.Commands["status"].innerFlagsLong["output"].CompleteValues(func(prefix string) []string {
+		return []string{prefix + "1", prefix + "2"}
+	})
+	buf := new(bytes.Buffer)
+	parser.SetOutput(buf)
+	if _, err := parser.Parse([]string{COMPLETE_COMMAND, "--", "status", "-o", "out"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if res := buf.String(); res != "out1\nout2\n" {
+		t.Errorf("Wrong candidates %q", res)
+	}
+	if len(parser.ExecutedCommands()) != 0 {
+		t.Errorf("No command should be executed while completing")
+	}
+
+	for _, generate := range []func(*Parser, *bytes.Buffer) error{
+		func(p *Parser, w *bytes.Buffer) error { return p.GenerateBashCompletion(w) },
+		func(p *Parser, w *bytes.Buffer) error { return p.GenerateZshCompletion(w) },
+		func(p *Parser, w *bytes.Buffer) error { return p.GenerateFishCompletion(w) },
+	} {
+		buf.Reset()
+		if err := generate(parser, buf); err != nil || !strings.Contains(buf.String(), COMPLETE_COMMAND+" --") {
+			t.Errorf("The completion script doesn't call %v (%v):\n%v", COMPLETE_COMMAND, err, buf.String())
+		}
+	}
+	buf.Reset()
+	parser.GenerateZshCompletion(buf)
+	//zsh drops the empty word under the cursor from unquoted arrays
+	if !strings.Contains(buf.String(), `__complete -- "${(@)words[$1,CURRENT]}"`) {
+		t.Errorf("The empty word under the cursor is not passed:\n%v", buf.String())
+	}
+	if res := strings.Join(parser.Complete([]string{"status", "--output", ""}), ","); res != "1,2" {
+		t.Errorf("Wrong values after the option %q", res)
+	}
+	buf.Reset()
+	if err := completionParser().GenerateBashCompletion(buf); err != nil || strings.Contains(buf.String(), COMPLETE_COMMAND) {
+		t.Errorf("No option completes its values, the program shouldn't be called (%v):\n%v", err, buf.String())
+	}
+
+	completed := false
+	parser.AddCommand(COMPLETE_COMMAND, "", "", func(string, ...string) error {
+		completed = true
+		return nil
+	}).SetArity(-1, "")
+	if _, err := parser.Parse([]string{COMPLETE_COMMAND, "status"}); err != nil || !completed {
+		t.Errorf("The command added should take the place of the built-in one (%v)", err)
+	}
+}
@@ -1,5 +1,10 @@
 package subcommand
 
+import (
+	"fmt"
+	"strings"
+)
+
 type ParsingError struct {
 	Description string
 	Command     Command
@@ -8,3 +13,156 @@ type ParsingError struct {
 func (e ParsingError) Error() string {
 	return e.Description
 }
+
+//UnknownFlagError is returned when a flag is not defined for the command being parsed
+type UnknownFlagError struct {
+	//The flag as found in the arguments (--flag or -f)
+	Flag    string
+	Command Command
+	//The closest flag defined for the command (--flag), empty if none is close enough
+	Suggestion string
+	//Index of the flag in the arguments, once the response files are expanded
+	Pos int
+}
+
+func (e UnknownFlagError) Error() string {
+	return fmt.Sprintf("%v is not a valid flag for %v", e.Flag, e.Command.Name) + didYouMean(e.Suggestion)
+}
+
+//MissingValueError is returned when an option is found but no value follows it
+type MissingValueError struct {
+	//The flag as found in the arguments (--option or -o)
+	Flag    string
+	Command Command
+	//Index of the flag in the arguments, once the response files are expanded
+	Pos int
+}
+
+func (e MissingValueError) Error() string {
+	return fmt.Sprintf("No value for option %v", e.Flag)
+}
+
+//MissingMandatoryError is returned when a mandatory flag is not present in the arguments
+type MissingMandatoryError struct {
+	//Long definition of the missing flag
+	Flag    string
+	Command Command
+}
+
+func (e MissingMandatoryError) Error() string {
+	return fmt.Sprintf("option/switch %v is mandatory for command %v", dashed(e.Flag, e.Command), e.Command.Name)
+}
+
+//ArityError is returned when the number of arguments passed to a command doesn't match its arity
+type ArityError struct {
+	Command Command
+	//The arguments found
+	Values []string
+}
+
+func (e ArityError) Error() string {
+	return fmt.Sprintf("Arity: Command %s accepts %v parameters but %v found (%v)",
+		e.Command.Name, e.Command.Arity(), len(e.Values), e.Values)
+}
+
+//ValidationError is returned when a flag value doesn't pass one of its validations
+type ValidationError struct {
+	//Long definition of the flag
+	Flag    string
+	Value   string
+	Command Command
+	//The error returned by the validation
+	Err error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid value %q for %v: %v", e.Value, dashed(e.Flag, e.Command), e.Err)
+}
+
+//FlagError is returned when a flag function fails
+type FlagError struct {
+	//Long definition of the flag
+	Flag    string
+	Command Command
+	//The error returned by the function
+	Err error
+}
+
+func (e FlagError) Error() string {
+	return fmt.Sprintf("error processing %v: %v", dashed(e.Flag, e.Command), e.Err)
+}
+
+func (e FlagError) Unwrap() error {
+	return e.Err
+}
+
+//CommandError is returned when a command function fails
+type CommandError struct {
+	Command Command
+	//The error returned by the function
+	Err error
+}
+
+func (e CommandError) Error() string {
+	return fmt.Sprintf("error running command %q: %v", e.Command.Name, e.Err)
+}
+
+func (e CommandError) Unwrap() error {
+	return e.Err
+}
+
+//ScriptError is returned by Parser.ParseScript when a line fails
+type ScriptError struct {
+	//Number of the failing line, starting at 1
+	Line int
+	//The error returned when parsing the line
+	Err error
+}
+
+func (e ScriptError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Err)
+}
+
+func (e ScriptError) Unwrap() error {
+	return e.Err
+}
+
+//UnknownCommandError is returned when the program receives arguments that are not a command
+type UnknownCommandError struct {
+	//The argument that was not recognised as a command
+	Value   string
+	Command Command
+	//The closest command name, empty if none is close enough
+	Suggestion string
+}
+
+func (e UnknownCommandError) Error() string {
+	return fmt.Sprintf("%v: subcommand not found %v", e.Command.Name, e.Value) + didYouMean(e.Suggestion)
+}
+
+//returns the flag name as typed in the arguments, -s for the flags defined with a short form only
+func dashed(name string, command Command) string {
+	if flag, ok := command.lookupFlag(command.key(name), false); ok && flag.Long == "" {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+//appends the suggestion to an error message
+func didYouMean(suggestion string) string {
+	if suggestion == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %v?", suggestion)
+}
+
+//ParsingErrors aggregates all the errors found when checking the arguments (see Parser.CollectErrors)
+type ParsingErrors []error
+
+func (e ParsingErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -1,8 +1,14 @@
 package subcommand
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 //FlagType defines the different flag types. Options have values associated to the flag, Switches have no value associated.
@@ -16,6 +22,21 @@ const (
 //Convinience type for funcions passed flags
 type FlagFunction func(string, string) error
 
+//FlagHandler is implemented by types handling flags, Set receives the same arguments as a FlagFunction
+type FlagHandler interface {
+	Set(name, value string) error
+}
+
+//Flag function receiving the context passed to Parser.ParseContext
+type FlagFunctionCtx func(ctx context.Context, name, value string) error
+
+//Flag function told if the flag was typed in its short form (-f) or the long one (--flag). It's
+//false as well when the value comes from the environment or the defaults
+type FlagFunctionForm func(name, value string, short bool) error
+
+//Flag function receiving the arguments after the flag, it returns how many of them it consumed
+type FlagConsumer func(name string, args []string) (consumed int, err error)
+
 //Flag structure
 type Flag struct {
 	//long definition (--option OPTION)
@@ -32,16 +53,249 @@ type Flag struct {
 	Type FlagType
 	//Function to call when the flag is found during the parsing process
 	fn func(string, string) error
+	//Used instead of fn when set
+	ctxFn FlagFunctionCtx
+	//Used instead of fn when set, unless ctxFn is set as well
+	formFn FlagFunctionForm
 	//Says if the flag is optional or mandatory
 	Mandatory bool
+	//Environment variable used when the flag is not present in the arguments
+	env string
+	//Value used when the flag is not present in the arguments, the environment nor the loaded defaults
+	defaultValue string
+	hasDefault   bool
+	//Function to call for count switches with the number of occurrences
+	counter func(string, int) error
+	//Function to call for list options with the elements of every occurrence
+	list      func(string, []string) error
+	separator string
+	//Hidden flags are not shown in the help
+	hidden bool
+	//Message shown when a deprecated flag is used
+	deprecation string
+	//Functions checking the flag value before calling fn
+	validators []func(string) error
+	//Number of values following an option in the arguments
+	nargs int
+	//Decides how many arguments the flag takes, used instead of nargs when set
+	consumer FlagConsumer
+	//The - value stands for the standard input
+	stdin bool
+	//Value used when the option is found without a value after =, the following argument is not taken
+	optionalValue string
+	hasOptional   bool
+	//Bool flags are switched off by --no-flag
+	negatable bool
+	//Global flags are listed in the help of every command
+	global bool
+	//Returns the values completing the prefix, see Parser.Complete
+	completer func(prefix string) []string
+	//Value found during the last parsing process, shared by the copies of the flag
+	result *flagResult
 }
 
+//Outcome of the last parsing process for a flag
+type flagResult struct {
+	value string
+	set   bool
+	count int
+}
+
+//Guards the flag results and the visited flags, published once a parsing process is over
+var resultsLock sync.RWMutex
+
 //Must sets the flag as mandatory. The parser will raise an error in case it isn't present in the arguments
-//TODO make sure that switches are not allowed to get mandatory
+//Only options can be mandatory, it panics for switches
 func (f *Flag) Must(isIt bool) {
+	if isIt && f.Type == Switch {
+		panic(fmt.Sprintf("Switch %v can't be mandatory", f.name()))
+	}
 	f.Mandatory = isIt
 }
 
+//Env binds the flag to the environment variable varName. If the flag is not present in the arguments
+//and the variable is set its value is used instead. Switches are activated when the variable
+//holds a truthy value (1, true or yes)
+func (f *Flag) Env(varName string) *Flag {
+	f.env = varName
+	return f
+}
+
+//Value standing for the standard input in the options allowing it (see Flag.AllowStdin)
+const STDIN_VALUE = "-"
+
+//Count returns the number of times the flag was found during the last parsing process, also within
+//clusters of short switches (-vvv). A value from the environment or the defaults counts as one
+func (f Flag) Count() int {
+	if f.result == nil {
+		return 0
+	}
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	return f.result.count
+}
+
+//Reader used when an option value stands for the standard input
+var stdin io.Reader = os.Stdin
+
+//IsStdin returns true if the option value stands for the standard input
+func IsStdin(value string) bool {
+	return value == STDIN_VALUE
+}
+
+//AllowStdin makes the option accept - as the standard input when its value is opened with Open
+func (f *Flag) AllowStdin() *Flag {
+	f.stdin = true
+	return f
+}
+
+//Open opens the file named by the option value, or returns the standard input for - if the option
+//allows it. The caller is responsible for closing it
+func (f Flag) Open(value string) (io.ReadCloser, error) {
+	if f.stdin && IsStdin(value) {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.Open(value)
+}
+
+//FormFunction sets the function called instead of the flag one, which is told in which form the
+//flag was typed. Useful to deprecate just the short form of a flag for instance
+func (f *Flag) FormFunction(fn FlagFunctionForm) *Flag {
+	f.formFn = fn
+	return f
+}
+
+//Default sets the value used when the flag is not present in the arguments, the environment nor
+//the defaults loaded with Parser.LoadDefaults. The flag function is called with it as if it was
+//found in the arguments. Switches are activated by truthy values (1, true or yes)
+func (f *Flag) Default(value string) *Flag {
+	f.defaultValue = value
+	f.hasDefault = true
+	return f
+}
+
+//Metavar sets the placeholder of the option value shown in the help (--output FILE), the upper
+//cased name by default. It's the same as the values passed to AddOption, for the options added
+//without them (AddFloatOption, AddListOption...)
+func (f *Flag) Metavar(name string) *Flag {
+	f.Values = name
+	return f
+}
+
+//OptionalValue makes the value of the option optional. It's given only after = (--color=never) or
+//attached to the short form (-cnever), otherwise the option gets value and the argument following
+//it is not taken. It panics for switches
+func (f *Flag) OptionalValue(value string) *Flag {
+	if f.Type == Switch {
+		panic(fmt.Sprintf("Switch %v doesn't accept values", f.name()))
+	}
+	f.optionalValue = value
+	f.hasOptional = true
+	return f
+}
+
+//CompleteValues sets the function returning the values of the option starting with the typed
+//prefix, used by Parser.Complete. It's called while completing, not parsing, so it shouldn't have
+//side effects. It panics for switches
+func (f *Flag) CompleteValues(fn func(prefix string) []string) *Flag {
+	if f.Type == Switch {
+		panic(fmt.Sprintf("Switch %v doesn't accept values", f.name()))
+	}
+	f.completer = fn
+	return f
+}
+
+//Global marks a flag of the parser as global. The parser flags are accepted after any command name
+//anyway, as the commands look for the flags of their parents, global ones are listed besides in the
+//help of every command under Global Options. A command flag with the same definition shadows it
+func (f *Flag) Global(isIt bool) *Flag {
+	f.global = isIt
+	return f
+}
+
+//IsGlobal returns true if the flag is listed in the help of every command
+func (f Flag) IsGlobal() bool {
+	return f.global
+}
+
+//Hidden hides the flag from the help. Hidden flags are parsed as any other flag
+func (f *Flag) Hidden(isIt bool) *Flag {
+	f.hidden = isIt
+	return f
+}
+
+//IsHidden returns true if the flag is hidden from the help
+func (f Flag) IsHidden() bool {
+	return f.hidden
+}
+
+//Deprecated marks the flag as deprecated. The flag keeps working but every time it's found in the arguments
+//the message is written to the standard error. Combine it with Hidden to remove the flag from the help
+func (f *Flag) Deprecated(message string) *Flag {
+	f.deprecation = message
+	return f
+}
+
+//Validate adds a validation function for the flag value. Validations are executed in the order they
+//were added once the flags are parsed and before calling any flag function. The first failing validation
+//aborts the parsing process
+func (f *Flag) Validate(fn func(value string) error) *Flag {
+	f.validators = append(f.validators, fn)
+	return f
+}
+
+//Nargs sets the number of values following the option in the arguments (--point X Y). The function
+//receives the values joined by a space. It panics for switches or if n is lower than one
+func (f *Flag) Nargs(n int) *Flag {
+	if f.Type == Switch {
+		panic(fmt.Sprintf("Switch %v doesn't accept values", f.name()))
+	}
+	if n < 1 {
+		panic(fmt.Sprintf("Option %v needs at least one value, got %v", f.name(), n))
+	}
+	f.nargs = n
+	return f
+}
+
+//Value returns the value the flag got during the last parsing process, the last one if it was found
+//several times. It's empty for switches and for flags not set
+func (f Flag) Value() string {
+	if f.result == nil {
+		return ""
+	}
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	return f.result.value
+}
+
+//WasSet returns true if the flag was found during the last parsing process, either in the arguments,
+//the environment or the defaults
+func (f Flag) WasSet() bool {
+	if f.result == nil {
+		return false
+	}
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	return f.result.set
+}
+
+//Returns the name identifying the flag, the long definition or the short one for flags without it
+func (f Flag) name() string {
+	if f.Long == "" {
+		return f.Short
+	}
+	return f.Long
+}
+
+//Checks if the value of a environment variable activates a switch
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.Trim(value, " ")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
 //Gets a help friendly flag representation:
 //-o,--option  OPTION           This option does this and that
 //-s,--switch                   This is a switch
@@ -50,23 +304,29 @@ func (f Flag) String() string {
 	return fmt.Sprintf("%s\t%s", f.FlagStringPrefix(), f.ShortDesc)
 }
 
+//Gets the flag definitions as shown in the help. Flags without short definition are indented as if
+//they had one, so the long definitions are aligned:
+//-o,--option OPTION
+//   --long-only
 func (f Flag) FlagStringPrefix() string {
-	var format string
 	var prefix string
-	var values string = f.Values
-	shortFormat := "%v"
-	if f.Short != "" {
-		shortFormat = "-%v,"
+	switch {
+	case f.Long == "":
+		prefix = "-" + f.Short
+	case f.Short == "":
+		prefix = "   --" + f.Long //as wide as -o,
+	default:
+		prefix = "-" + f.Short + ",--" + f.Long
 	}
-	if values ==  "" {
-		values = strings.ToUpper(f.Long)
+	if f.negatable {
+		prefix = strings.Replace(prefix, "--"+f.Long, "--[no-]"+f.Long, 1)
 	}
 	if f.Type == Option {
-		format = "--%v %v"
-		prefix = fmt.Sprintf(shortFormat+format, f.Short, f.Long, values)
-	} else {
-		format = "--%v"
-		prefix = fmt.Sprintf(shortFormat+format, f.Short, f.Long)
+		values := f.Values
+		if values == "" {
+			values = strings.ToUpper(f.name())
+		}
+		prefix += " " + values
 	}
 	return prefix
 }
@@ -77,12 +337,17 @@ func checkDefinition(flag string) bool {
 	return len(parts) == 1
 }
 
+//Checks that the short definition is at most one character
+func checkShort(short string) bool {
+	return utf8.RuneCountInString(short) <= 1
+}
+
 //builds the flag struct panicking if errors are encountered
 func buildFlag(long, short, shortDesc, longDesc, values string, fn FlagFunction, kind FlagType) *Flag {
 	long = strings.Trim(long, " ")
 	short = strings.Trim(short, " ")
-	if len(long) == 0 {
-		panic("Long definition is empty")
+	if len(long) == 0 && len(short) == 0 {
+		panic("Long and short definitions are empty")
 	}
 	if longDesc == "" {
 		longDesc = shortDesc
@@ -95,6 +360,10 @@ func buildFlag(long, short, shortDesc, longDesc, values string, fn FlagFunction,
 	if !checkDefinition(short) {
 		panic(fmt.Sprintf("Short definition %v has two words. Only one is accepted", long))
 	}
+
+	if strings.HasPrefix(long, "-") || strings.HasPrefix(short, "-") {
+		panic(fmt.Sprintf("Definitions %q and %q can't start with -, the parser adds the dashes", long, short))
+	}
 	return &Flag{
 		Type:        kind,
 		Long:        long,
@@ -104,5 +373,7 @@ func buildFlag(long, short, shortDesc, longDesc, values string, fn FlagFunction,
 		LongDesc:    longDesc,
 		Values:      values,
 		Mandatory:   false,
+		nargs:       1,
+		result:      &flagResult{},
 	}
 }
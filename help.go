@@ -1,73 +1,302 @@
 package subcommand
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 )
 
+//Writer where the help is written to unless the parser sets its own (see Parser.SetOutput)
 var output io.Writer = os.Stdout
 
+//Width used to wrap the help when the output is not a terminal
+const DEFAULT_HELP_WIDTH = 80
+
+//Returns the width the help written to w is wrapped to: the terminal width or the COLUMNS variable,
+//falling back to DEFAULT_HELP_WIDTH
+var helpWidth = func(w io.Writer) int {
+	if f, ok := w.(*os.File); ok {
+		if cols := terminalColumns(f); cols > 0 {
+			return cols
+		}
+	}
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols
+	}
+	return DEFAULT_HELP_WIDTH
+}
+
+//ColorMode defines when the help highlights the command and flag names
+type ColorMode int
+
+const (
+	//Plain text help
+	ColorNever ColorMode = iota
+	//Highlight the names when the output is a terminal
+	ColorAuto
+	//Always highlight the names
+	ColorAlways
+)
+
+//ANSI codes enclosing the highlighted names
+const (
+	highlightStart = "\x1b[1m"
+	highlightEnd   = "\x1b[0m"
+)
+
 const (
 	PARSER_HELP_TEMPLATE = `
-Usage {{.Name}} [GLOBAL_OPTIONS]{{if .Arity.Count}} {{.Arity.Description}}{{end}} command [COMMAND_OPTIONS] [PARAMS]
-{{if .Flags}}
+{{with usage}}Usage: {{.}}{{else}}Usage {{.Name}} [GLOBAL_OPTIONS]{{with .Arity.Description}} {{.}}{{end}} command [COMMAND_OPTIONS] [PARAMS]{{end}}
+{{with helpFlags .Flags}}
 global options:
 
-{{range .Flags }}       {{flagAligner .FlagStringPrefix}} {{.Description}}
+{{range . }}       {{flagAligner .FlagStringPrefix}} {{flagDesc (helpDesc .)}}
 {{end}}{{end}}
-{{if .Commands}}
+{{with helpCommands .Commands}}
 commands:
 
-        {{range .Commands}}{{commandAligner .Name }} {{.Description}}
+        {{range .}}{{commandAligner (synopsis .) }} {{commandDesc .ShortDesc}}
         {{end}}
-{{end}}
-`
+{{end}}{{with examples}}Examples:
+{{.}}
+{{end}}{{with epilog}}
+{{.}}
+{{end}}`
 	COMMAND_HELP_TEMPLATE = `
-Usage: {{.Parent.Name}} [GLOBAL_OPTIONS] {{.Name}} [OPTIONS]  {{if .Arity.Count}} {{.Arity.Description}}{{end}}
-{{.Description}}
-{{if .Flags}}
+{{with usage}}Usage: {{.}}{{else}}Usage: {{.Parent.Name}} [GLOBAL_OPTIONS] {{.Name}} [OPTIONS]  {{if .Arity.Count}} {{.Arity.Description}}{{end}}{{end}}
+{{.LongDesc}}
+{{with helpFlags .Flags}}
 Options:
-{{range .Flags }}       {{flagAligner .FlagStringPrefix}} {{.Description}}
+{{range . }}       {{flagAligner .FlagStringPrefix}} {{flagDesc (helpDesc .)}}
 {{end}}
+{{end}}{{with globalFlags}}Global Options:
+{{range . }}       {{flagAligner .FlagStringPrefix}} {{flagDesc (helpDesc .)}}
 {{end}}
-`
+{{end}}{{with examples}}Examples:
+{{.}}
+{{end}}`
 )
 
-func defaultHelp(p Parser) CommandFunction {
+func defaultHelp(p *Parser) CommandFunction {
 	return func(help string, args ...string) error {
 		var funcMap template.FuncMap
 		var tempText string
 		var element interface{}
+		w := p.writer()
+		width := helpWidth(w)
+		paint := highlighter(p.color, w)
 
 		if len(args) > 0 {
-			if cmd, ok := p.Commands[args[0]]; ok {
+			//commands have no subcommands, so the path can't go further than the first one
+			path := args[:1]
+			cmd, ok := p.Commands[p.key(args[0])]
+			if ok && len(args) > 1 {
+				path, ok = args[:2], false
+			}
+			if ok {
+				//both lists are aligned
+				globals := globalFlags(p, cmd)
+				flags := append(visibleFlags(cmd.Flags()), globals...)
 				funcMap = template.FuncMap{
-					"flagAligner": flagAligner(cmd.Flags()),
+					"flagAligner": painted(flagAligner(flags), paint),
+					"flagDesc":    wrapper(flagColumn(flags), width),
+					"helpFlags":   helpFlags,
+					"globalFlags": func() []Flag { return globals },
+					"helpDesc":    helpDesc,
+					"usage":       usageLine(cmd.usage, cmd),
+					"examples":    func() string { return cmd.examples },
 				}
 				tempText = COMMAND_HELP_TEMPLATE
 				element = cmd
 
 			} else {
-				fmt.Printf("help: command not found %v\n", args[0])
+				_, err := fmt.Fprintf(w, "help: command not found %v\n", strings.Join(path, " "))
+				return err
 			}
 		} else {
 			funcMap = template.FuncMap{
-				"commandAligner": commandAligner(p.Commands),
-				"flagAligner":    flagAligner(p.Flags()),
+				"commandAligner": painted(commandAligner(visibleCommands(p.Commands)), paint),
+				"flagAligner":    painted(flagAligner(visibleFlags(p.Flags())), paint),
+				"flagDesc":       wrapper(flagColumn(visibleFlags(p.Flags())), width),
+				"commandDesc":    wrapper(commandColumn(visibleCommands(p.Commands)), width),
+				"helpFlags":      helpFlags,
+				"helpDesc":       helpDesc,
+				"helpCommands":   helpCommands,
+				"synopsis":       synopsis,
+				"usage":          usageLine(p.usage, p),
+				"examples":       func() string { return p.examples },
+				"epilog":         func() string { return p.epilog },
 			}
 			tempText = PARSER_HELP_TEMPLATE
-			element = &p
+			element = p
 		}
 		tmpl := template.Must(template.New("").Funcs(funcMap).Parse(tempText))
-		return tmpl.Execute(output, element)
+		return tmpl.Execute(w, element)
+	}
+}
+
+//returns the function highlighting the names written to w according to mode, which leaves them as
+//they are when the help is not colored
+func highlighter(mode ColorMode, w io.Writer) func(string) string {
+	colored := mode == ColorAlways
+	if mode == ColorAuto {
+		f, ok := w.(*os.File)
+		colored = ok && terminalColumns(f) > 0
+	}
+	if !colored {
+		return func(name string) string { return name }
+	}
+	return func(name string) string { return highlightStart + name + highlightEnd }
+}
+
+//paints the name aligned by align, the padding is computed on the plain name
+func painted(align func(string) string, paint func(string) string) func(string) string {
+	return func(name string) string {
+		return paint(name) + align(name)[len(name):]
+	}
+}
+
+//renders the usage line defined for a command, if any. The usage is a template executed with the
+//command (or parser) as data
+func usageLine(usage string, element interface{}) func() (string, error) {
+	return func() (string, error) {
+		if usage == "" {
+			return "", nil
+		}
+		tmpl, err := template.New("usage").Parse(usage)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, element); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+//column where the flag descriptions start, after the indentation, the aligned flag and a space
+func flagColumn(flags []Flag) int {
+	return 7 + getLongestFlag(flags) + 4 + 1
+}
+
+//column where the command descriptions start
+func commandColumn(commands map[string]*Command) int {
+	return 8 + getLongestSynopsis(commands) + 4 + 1
+}
+
+//returns a function wrapping the descriptions starting at column so the lines fit in width.
+//Continuation lines are indented up to the column. Words are never split, and descriptions are
+//given at least 20 characters per line however narrow the width is
+func wrapper(column, width int) func(string) string {
+	available := width - column
+	if available < 20 {
+		available = 20
+	}
+	indent := "\n" + strings.Repeat(" ", column)
+	return func(desc string) string {
+		var lines []string
+		line := ""
+		for _, word := range strings.Fields(desc) {
+			if line != "" && len(line)+1+len(word) > available {
+				lines = append(lines, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, indent)
+	}
+}
+
+//returns the flag description as shown in the help, marking the mandatory flags
+func helpDesc(f Flag) string {
+	if !f.Mandatory {
+		return f.ShortDesc
+	}
+	if f.ShortDesc == "" {
+		return "(required)"
+	}
+	return f.ShortDesc + " (required)"
+}
+
+//filters out the hidden flags
+func visibleFlags(flags []Flag) []Flag {
+	visible := make([]Flag, 0)
+	for _, f := range flags {
+		if !f.hidden {
+			visible = append(visible, f)
+		}
+	}
+	return visible
+}
+
+//returns the visible flags sorted by long name, as shown in the help
+func helpFlags(flags []Flag) []Flag {
+	sorted := visibleFlags(flags)
+	sort.Sort(byLong(sorted))
+	return sorted
+}
+
+//returns the visible global flags of the parser not shadowed by the command ones, sorted by long name
+func globalFlags(p *Parser, cmd *Command) []Flag {
+	var globals []Flag
+	for _, f := range helpFlags(p.Flags()) {
+		if f.global && !shadowed(f, cmd.Flags()) {
+			globals = append(globals, f)
+		}
 	}
+	return globals
+}
+
+//returns the visible commands sorted by name, as shown in the help
+func helpCommands(commands map[string]*Command) []*Command {
+	sorted := make([]*Command, 0, len(commands))
+	for _, c := range visibleCommands(commands) {
+		sorted = append(sorted, c)
+	}
+	sort.Sort(byName(sorted))
+	return sorted
+}
+
+//Sorts the flags by long name, or the short one for flags without it
+type byLong []Flag
+
+func (f byLong) Len() int           { return len(f) }
+func (f byLong) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byLong) Less(i, j int) bool { return f[i].name() < f[j].name() }
+
+//filters out the hidden commands
+func visibleCommands(commands map[string]*Command) map[string]*Command {
+	visible := make(map[string]*Command)
+	for name, c := range commands {
+		if !c.hidden {
+			visible[name] = c
+		}
+	}
+	return visible
+}
+
+//returns the command name followed by the description of its parameters, if it accepts any
+func synopsis(c *Command) string {
+	if c.arity.Max == 0 || c.arity.Description == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.arity.Description
 }
 
 func commandAligner(commands map[string]*Command) func(string) string {
-	longest := getLongestName(commands)
+	longest := getLongestSynopsis(commands)
 	return func(name string) string {
 		return fmt.Sprintf("%s%s", name, strings.Repeat(" ", longest-len(name)+4))
 	}
@@ -88,6 +317,15 @@ func getLongestFlag(flags []Flag) int {
 	}
 	return max
 }
+func getLongestSynopsis(commands map[string]*Command) int {
+	max := -1
+	for _, s := range commands {
+		if max < len(synopsis(s)) {
+			max = len(synopsis(s))
+		}
+	}
+	return max
+}
 func getLongestName(commands map[string]*Command) int {
 	max := -1
 	for _, s := range commands {
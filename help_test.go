@@ -1,20 +1,25 @@
 package subcommand
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
 func TestGetLongestFlag(t *testing.T) {
-	f1 := buildFlag("1234", "", "", func(string, string) error { return nil }, Option)
-	f2 := buildFlag("1235", "a", "", func(string, string) error { return nil }, Option)
+	f1 := buildFlag("1234", "", "", "", "", func(string, string) error { return nil }, Option)
+	f2 := buildFlag("1235", "a", "", "", "", func(string, string) error { return nil }, Option)
 	//f2 is longer for the shot desc
 	res := getLongestFlag([]Flag{*f1, *f2})
 	if res != len(f2.FlagStringPrefix()) {
 		t.Error("longest flag wasn't f2")
 	}
 
-	f3 := buildFlag("1236", "", "", func(string, string) error { return nil }, Switch)
+	f3 := buildFlag("1236", "", "", "", "", func(string, string) error { return nil }, Switch)
 	res = getLongestFlag([]Flag{*f1, *f3})
 	//longest f1 for the [OPTION] part
 	if res != len(f1.FlagStringPrefix()) {
@@ -24,8 +29,8 @@ func TestGetLongestFlag(t *testing.T) {
 
 func TestFlagAligner(t *testing.T) {
 
-	f1 := buildFlag("1234", "", "", func(string, string) error { return nil }, Option)
-	f2 := buildFlag("1235", "a", "", func(string, string) error { return nil }, Option)
+	f1 := buildFlag("1234", "", "", "", "", func(string, string) error { return nil }, Option)
+	f2 := buildFlag("1235", "a", "", "", "", func(string, string) error { return nil }, Option)
 	aligner := flagAligner([]Flag{*f1, *f2})
 
 	if len(aligner(f1.FlagStringPrefix())) != len(aligner(f2.FlagStringPrefix())) {
@@ -35,10 +40,10 @@ func TestFlagAligner(t *testing.T) {
 
 func TestGetLongestName(t *testing.T) {
 	parent := &Command{}
-	command1 := newCommand(parent, "c1", "", func(string, ...string) error {
+	command1 := newCommand(parent, "c1", "", "", func(string, ...string) error {
 		return nil
 	})
-	command2 := newCommand(parent, "co2", "", func(string, ...string) error {
+	command2 := newCommand(parent, "co2", "", "", func(string, ...string) error {
 		return nil
 	})
 
@@ -50,10 +55,10 @@ func TestGetLongestName(t *testing.T) {
 
 func TestCommandAligner(t *testing.T) {
 	parent := &Command{}
-	command1 := newCommand(parent, "c1", "", func(string, ...string) error {
+	command1 := newCommand(parent, "c1", "", "", func(string, ...string) error {
 		return nil
 	})
-	command2 := newCommand(parent, "co2", "", func(string, ...string) error {
+	command2 := newCommand(parent, "co2", "", "", func(string, ...string) error {
 		return nil
 	})
 	aligner := commandAligner(map[string]*Command{command1.Name: command1, command2.Name: command2})
@@ -69,7 +74,7 @@ func TestHelp(t *testing.T) {
 	parser.AddOption("option", "o", "This is an option", "", "", func(name, val string) error {
 		return nil
 	})
-	parser.AddCommand("command", "desc", func(string, ...string) error {
+	parser.AddCommand("command", "desc", "", func(string, ...string) error {
 		return nil
 	}).AddOption("cop", "", "", "", "", func(string, string) error {
 		return nil
@@ -84,3 +89,512 @@ func TestHelp(t *testing.T) {
 		t.Errorf("Unexpected error %v", err)
 	}
 }
+
+func TestHelpHidden(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.AddOption("visible", "v", "This is an option", "", "", emptyFn)
+	parser.AddSwitch("debug", "d", "This is a hidden switch", emptyFn).Hidden(true)
+	parser.AddCommand("internal", "hidden command", "", emptyFnMult).Hidden(true)
+	cmd := parser.AddCommand("command", "desc", "", emptyFnMult)
+	cmd.AddOption("secret", "", "", "", "", emptyFn).Hidden(true)
+
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if res := buf.String(); !strings.Contains(res, "--visible") || strings.Contains(res, "--debug") || strings.Contains(res, "internal") {
+		t.Errorf("Hidden flags or commands shown in help:\n%v", res)
+	}
+	buf.Reset()
+	if _, err := parser.Parse([]string{"help", "command"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if res := buf.String(); strings.Contains(res, "--secret") {
+		t.Errorf("Hidden flag shown in command help:\n%v", res)
+	}
+	//hidden flags are still parsed
+	if _, err := parser.Parse([]string{"--debug", "command", "--secret", "val"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestHelpUsage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.Usage("{{.Name}} [OPTIONS] FILE")
+	parser.AddCommand("command", "desc", "", emptyFnMult).Usage("test command SRC DST")
+	parser.AddCommand("other", "desc", "", emptyFnMult)
+
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if res := buf.String(); !strings.Contains(res, "Usage: test [OPTIONS] FILE\n") || strings.Contains(res, "GLOBAL_OPTIONS") {
+		t.Errorf("Parser usage not used:\n%v", res)
+	}
+	buf.Reset()
+	parser.Parse([]string{"help", "command"})
+	if res := buf.String(); !strings.Contains(res, "Usage: test command SRC DST\n") {
+		t.Errorf("Command usage not used:\n%v", res)
+	}
+	buf.Reset()
+	parser.Parse([]string{"help", "other"})
+	if res := buf.String(); !strings.Contains(res, "Usage: test [GLOBAL_OPTIONS] other [OPTIONS]") {
+		t.Errorf("Generic usage not used:\n%v", res)
+	}
+}
+
+func TestHelpSorted(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.AddSwitch("zeta", "z", "", emptyFn)
+	parser.AddSwitch("alpha", "a", "", emptyFn)
+	parser.AddCommand("second", "", "", emptyFnMult)
+	parser.AddCommand("first", "", "", emptyFnMult)
+
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	if strings.Index(res, "--alpha") > strings.Index(res, "--zeta") {
+		t.Errorf("Flags not sorted:\n%v", res)
+	}
+	if strings.Index(res, "first") > strings.Index(res, "second") {
+		t.Errorf("Commands not sorted:\n%v", res)
+	}
+}
+
+func TestHelpArity(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.AddCommand("copy", "Copies", "", emptyFnMult).SetArity(2, "SRC DST")
+	parser.AddCommand("list", "Lists", "", emptyFnMult)
+	parser.AddCommand("status", "Shows", "", emptyFnMult).SetArity(0, "")
+
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	for _, line := range []string{"copy SRC DST           Copies", "list arg1 arg2 ...     Lists", "status                 Shows"} {
+		if !strings.Contains(res, line) {
+			t.Errorf("Line %q not found in help:\n%v", line, res)
+		}
+	}
+}
+
+func TestHelpRequired(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	cmd := parser.AddCommand("copy", "", "", emptyFnMult)
+	cmd.AddOption("output", "o", "Output file", "", "FILE", emptyFn).Must(true)
+	cmd.AddOption("mode", "m", "", "", "MODE", emptyFn).Must(true)
+	cmd.AddOption("level", "l", "Compression level", "", "", emptyFn)
+	cmd.AddSwitch("force", "f", "Overwrites", emptyFn)
+
+	if _, err := parser.Parse([]string{"help", "copy"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	for _, line := range []string{
+		"       -f,--force           Overwrites\n",
+		"       -l,--level LEVEL     Compression level\n",
+		"       -m,--mode MODE       (required)\n",
+		"       -o,--output FILE     Output file (required)\n",
+	} {
+		if !strings.Contains(res, line) {
+			t.Errorf("Line %q not found in help:\n%v", line, res)
+		}
+	}
+}
+
+func TestHelpPath(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.AddCommand("remote", "", "Manages the remotes", emptyFnMult)
+
+	for args, expected := range map[string]string{
+		"remote":            "Manages the remotes",
+		"remote add":        "help: command not found remote add\n",
+		"remote add origin": "help: command not found remote add\n",
+		"other add":         "help: command not found other\n",
+	} {
+		buf.Reset()
+		if _, err := parser.Parse(append([]string{"help"}, strings.Fields(args)...)); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if res := buf.String(); !strings.Contains(res, expected) {
+			t.Errorf("Wrong help for %q:\n%v", args, res)
+		}
+	}
+}
+
+func TestHelpColor(t *testing.T) {
+	help := func(mode ColorMode) string {
+		buf := new(bytes.Buffer)
+		parser := NewParser("test")
+		parser.SetOutput(buf)
+		parser.SetColor(mode)
+		parser.AddSwitch("verbose", "v", "Talks", emptyFn)
+		parser.AddCommand("copy", "Copies", "", emptyFnMult)
+		if _, err := parser.Parse([]string{"help"}); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		return buf.String()
+	}
+	plain := help(ColorNever)
+	if strings.Contains(plain, "\x1b[") {
+		t.Errorf("Colored help:\n%q", plain)
+	}
+	if res := help(ColorAuto); res != plain {
+		t.Errorf("Colored help for a buffer:\n%q", res)
+	}
+	res := help(ColorAlways)
+	for _, line := range []string{"\x1b[1m-v,--verbose\x1b[0m     Talks", "\x1b[1mcopy arg1 arg2 ...\x1b[0m     Copies"} {
+		if !strings.Contains(res, line) {
+			t.Errorf("Line %q not found in help:\n%q", line, res)
+		}
+	}
+	if strings.Replace(strings.Replace(res, highlightStart, "", -1), highlightEnd, "", -1) != plain {
+		t.Errorf("Colored help differs from the plain one")
+	}
+}
+
+func TestHelpOptions(t *testing.T) {
+	buf := new(bytes.Buffer)
+	parser := NewParser("test", WithHelpName("usage"))
+	parser.SetOutput(buf)
+	if _, err := parser.Parse([]string{"usage"}); err != nil || !strings.Contains(buf.String(), "Usage test") {
+		t.Errorf("Help not printed %v:\n%v", err, buf.String())
+	}
+	if _, err := parser.Parse([]string{"help"}); err == nil {
+		t.Errorf("help still a command")
+	}
+
+	parser = NewParser("test", WithoutHelp())
+	parser.SetOutput(buf)
+	buf.Reset()
+	for _, arg := range []string{"help", "--help", "-h"} {
+		if _, err := parser.Parse([]string{arg}); err == nil {
+			t.Errorf("%v accepted without help command", arg)
+		}
+	}
+	parser.OnCommand(emptyFnMult)
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Help printed:\n%v", buf.String())
+	}
+}
+
+func TestDisableHelp(t *testing.T) {
+	buf := new(bytes.Buffer)
+	parser := NewParser("test")
+	parser.SetOutput(buf)
+	parser.AddCommand("run", "", "", emptyFnMult)
+	parser.DisableHelp()
+	if _, err := parser.Parse([]string{"help"}); err == nil {
+		t.Errorf("help still a command")
+	}
+	if _, err := parser.Parse([]string{"run", "--help"}); err == nil {
+		t.Errorf("--help still a flag")
+	}
+	if err := parser.GenerateBashCompletion(buf); err != nil || strings.Contains(buf.String(), "help") {
+		t.Errorf("help completed %v:\n%v", err, buf.String())
+	}
+	buf.Reset()
+	parser.SetErrorHandling(PrintUsage)
+	if _, err := parser.Parse([]string{"--nope"}); err == nil || buf.String() != err.Error()+"\n" {
+		t.Errorf("Only the error should be printed %v:\n%v", err, buf.String())
+	}
+	without := NewParser("test", WithoutHelp())
+	without.SetOutput(ioutil.Discard)
+	without.SetErrorHandling(PrintUsage)
+	if _, err := without.Parse([]string{"--nope"}); err == nil {
+		t.Errorf("Expected an error for --nope")
+	}
+	parser.SetErrorHandling(ContinueOnError)
+	buf.Reset()
+	parser.SetHelp("help", "", defaultHelp(parser))
+	if _, err := parser.Parse([]string{"help"}); err != nil || !strings.Contains(buf.String(), "Usage test") {
+		t.Errorf("Help not printed %v:\n%v", err, buf.String())
+	}
+}
+
+func TestHelpExamples(t *testing.T) {
+	buf := new(bytes.Buffer)
+	parser := NewParser("test")
+	parser.SetOutput(buf)
+	parser.AddCommand("copy", "Copies", "", emptyFnMult).Examples("  test copy a b")
+	plain := parser.AddCommand("plain", "", "", emptyFnMult)
+
+	if _, err := parser.Parse([]string{"help", "plain"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	withoutExamples := buf.String()
+	plain.Examples("  test plain")
+	buf.Reset()
+	parser.Parse([]string{"help", "plain"})
+	if res := buf.String(); res != withoutExamples+"Examples:\n  test plain\n" {
+		t.Errorf("Wrong examples:\n%q\n%q", res, withoutExamples)
+	}
+
+	buf.Reset()
+	parser.Parse([]string{"help"})
+	withoutEpilog := buf.String()
+	parser.Examples("  test copy a b")
+	parser.Epilog("Report bugs to the tracker")
+	buf.Reset()
+	parser.Parse([]string{"help"})
+	if res := buf.String(); res != withoutEpilog+"Examples:\n  test copy a b\n\nReport bugs to the tracker\n" {
+		t.Errorf("Wrong epilog:\n%q", res)
+	}
+}
+
+func TestGlobalFlags(t *testing.T) {
+	buf := new(bytes.Buffer)
+	parser := NewParser("test")
+	parser.SetOutput(buf)
+	verbose := false
+	parser.AddGlobalSwitch("verbose", "v", "Be verbose", func(string, string) error {
+		verbose = true
+		return nil
+	})
+	parser.AddGlobalOption("config", "c", "Config file", "", "", emptyFn)
+	parser.AddSwitch("quiet", "q", "Be quiet", emptyFn)
+	parser.AddCommand("copy", "Copies", "", emptyFnMult).AddOption("output", "o", "Output file", "", "", emptyFn)
+	parser.AddCommand("plain", "", "", emptyFnMult).AddSwitch("verbose", "", "Plain verbose", emptyFn)
+
+	if _, err := parser.Parse([]string{"copy", "--verbose"}); err != nil || !verbose {
+		t.Errorf("The global flag should be accepted by the command (%v)", err)
+	}
+	parser.Parse([]string{"help", "copy"})
+	res := buf.String()
+	expected := "Options:\n       -o,--output OUTPUT     Output file\n\nGlobal Options:\n" +
+		"       -c,--config CONFIG     Config file\n       -v,--verbose           Be verbose\n"
+	if !strings.Contains(res, expected) || strings.Contains(res, "quiet") {
+		t.Errorf("Wrong global options:\n%v", res)
+	}
+	buf.Reset()
+	parser.Parse([]string{"help", "plain"})
+	if res := buf.String(); strings.Contains(res, "Be verbose") || !strings.Contains(res, "--config") {
+		t.Errorf("The command flag should shadow the global one:\n%v", res)
+	}
+	if !parser.innerFlagsLong["verbose"].IsGlobal() || parser.innerFlagsLong["quiet"].IsGlobal() {
+		t.Error("Wrong global marks")
+	}
+}
+
+func TestHelpWrap(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	width := helpWidth
+	helpWidth = func(io.Writer) int { return 50 }
+	defer func() { output = ioutil.Discard; helpWidth = width }()
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "Prints a lot of details about every single step taken", emptyFn)
+
+	if _, err := parser.Parse([]string{"help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	res := buf.String()
+	expected := "       -v,--verbose     Prints a lot of details\n" +
+		"                        about every single step\n" +
+		"                        taken\n"
+	if !strings.Contains(res, expected) {
+		t.Errorf("Description not wrapped:\n%v", res)
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	wrap := wrapper(10, 35)
+	if res := wrap("one two three four five six"); res != "one two three four five\n          six" {
+		t.Errorf("Wrong wrapping %q", res)
+	}
+	if res := wrap("unbreakablewordlongerthanthewidth"); res != "unbreakablewordlongerthanthewidth" {
+		t.Errorf("Wrong wrapping %q", res)
+	}
+	if res := wrapper(70, 80)("one two three four five six"); res != "one two three four\n"+strings.Repeat(" ", 70)+"five six" {
+		t.Errorf("Minimum width not honoured %q", res)
+	}
+}
+
+func TestErrorHandling(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	exited := -1
+	exit = func(code int) { exited = code }
+	defer func() { output = ioutil.Discard; exit = os.Exit }()
+	parser := NewParser("test")
+	parser.AddCommand("command", "", "", emptyFnMult).AddSwitch("inner", "i", "Inner switch", emptyFn)
+
+	if _, err := parser.Parse([]string{"command", "--unknown"}); err == nil || buf.Len() > 0 {
+		t.Errorf("Unexpected output %v %q", err, buf.String())
+	}
+	parser.SetErrorHandling(PrintUsage)
+	_, err := parser.Parse([]string{"command", "--unknown"})
+	if res := buf.String(); err == nil || !strings.HasPrefix(res, err.Error()+"\n") || !strings.Contains(res, "--inner") {
+		t.Errorf("Error and usage not printed %v:\n%v", err, res)
+	}
+	if exited != -1 {
+		t.Error("Exited with PrintUsage")
+	}
+	parser.SetErrorHandling(ExitOnError)
+	parser.Parse([]string{"--unknown"})
+	if exited != 2 {
+		t.Errorf("Wrong exit code %v", exited)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	output = errorWriter{}
+	defer func() { output = ioutil.Discard }()
+	buf := new(bytes.Buffer)
+	parser := NewParser("test")
+	parser.SetOutput(buf)
+	parser.SetVersion("1.0")
+	parser.AddCommand("first", "", "", emptyFnMult)
+	parser.AddCommand("second", "", "", emptyFnMult)
+
+	for _, args := range [][]string{{"help"}, {"help", "first"}, {"help", "unknown"}, {"--version"}} {
+		if _, err := parser.Parse(args); err != nil {
+			t.Errorf("Unexpected error %v for %v", err, args)
+		}
+	}
+	res := buf.String()
+	for _, expected := range []string{"first", "second", "help: command not found unknown", "test version 1.0"} {
+		if !strings.Contains(res, expected) {
+			t.Errorf("%q not written to the parser output:\n%v", expected, res)
+		}
+	}
+}
+
+type errorWriter struct{} //fails on any write, so nothing is written to the default output
+
+func (errorWriter) Write([]byte) (int, error) {
+	return 0, errors.New("written to the default output")
+}
+
+func TestHelpFlag(t *testing.T) {
+	parser := NewParser("test")
+	var helped []string
+	printed := false
+	parser.SetHelp("help", "", func(command string, args ...string) error {
+		helped = args
+		printed = true
+		return nil
+	})
+	called := false
+	parser.AddOption("mandatory", "m", "", "", "", emptyFn).Must(true)
+	cmd := parser.AddCommand("command", "", "", func(string, ...string) error {
+		called = true
+		return nil
+	})
+	cmd.AddOption("inner", "i", "", "", "", emptyFn).Must(true)
+
+	if _, err := parser.Parse([]string{"--help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !printed || len(helped) != 0 {
+		t.Errorf("Parser help not printed %v", helped)
+	}
+	helped = nil
+	if _, err := parser.Parse([]string{"-m", "val", "command", "-h"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(helped) != 1 || helped[0] != "command" {
+		t.Errorf("Command help not printed %v", helped)
+	}
+	if called {
+		t.Error("Command executed after the help flag")
+	}
+	//the mandatory flag of the parser is not checked
+	helped = nil
+	if _, err := parser.Parse([]string{"command", "--help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(helped) != 1 || helped[0] != "command" || called {
+		t.Errorf("Command help not printed %v", helped)
+	}
+
+	parser.SetHelpFlag(false)
+	if _, err := parser.Parse([]string{"--help"}); err == nil {
+		t.Error("Disabled help flag accepted")
+	}
+}
+
+func TestHelpFlagAsValue(t *testing.T) {
+	parser := NewParser("test")
+	var helped []string
+	parser.SetHelp("help", "", func(command string, args ...string) error {
+		helped = append(args, "printed")
+		return nil
+	})
+	var values []string
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	cmd.AddOption("output", "o", "", "", "", func(name, value string) error {
+		values = append(values, value)
+		return nil
+	})
+	if _, err := parser.Parse([]string{"command", "--output", "--help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(helped, " ") != "command printed" || len(values) != 0 {
+		t.Errorf("Help not printed %v, values %v", helped, values)
+	}
+	//given with = it's meant as the value
+	helped = nil
+	if _, err := parser.Parse([]string{"command", "--output=--help"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(helped) != 0 || len(values) != 1 || values[0] != "--help" {
+		t.Errorf("Help printed %v, values %v", helped, values)
+	}
+}
+
+func TestHelpFlagUserDefined(t *testing.T) {
+	parser := NewParser("test")
+	host := false
+	parser.AddSwitch("host", "h", "", func(string, string) error {
+		host = true
+		return nil
+	})
+	if _, err := parser.Parse([]string{"-h"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !host {
+		t.Error("User defined flag didn't take precedence")
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	defer func() { output = ioutil.Discard }()
+	parser := NewParser("test")
+	parser.AddOption("mandatory", "m", "", "", "", emptyFn).Must(true)
+	if _, err := parser.Parse([]string{"--version"}); err == nil {
+		t.Error("Version flag accepted without a version")
+	}
+	parser.SetVersion("1.2.3")
+	for _, flag := range []string{"--version", "-V"} {
+		buf.Reset()
+		if _, err := parser.Parse([]string{flag}); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if res := buf.String(); res != "test version 1.2.3\n" {
+			t.Errorf("Wrong version output %q", res)
+		}
+	}
+}
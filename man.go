@@ -0,0 +1,73 @@
+package subcommand
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+//GenerateManPage writes to w a man page in roff format for the parser with the NAME, SYNOPSIS,
+//OPTIONS and COMMANDS sections. The synopsis is the usage line of the parser (see Command.Usage).
+//Hidden commands and flags are left out. View it with man -l
+func (p *Parser) GenerateManPage(w io.Writer) error {
+	usage, err := usageLine(p.usage, p)()
+	if err != nil {
+		return err
+	}
+	if usage == "" {
+		usage = p.Name + " [GLOBAL_OPTIONS] command [COMMAND_OPTIONS] [PARAMS]"
+	}
+	var page []string
+	page = append(page, fmt.Sprintf(".TH %v 1", roffEscape(strings.ToUpper(p.Name))), ".SH NAME")
+	if p.ShortDesc != "" {
+		page = append(page, roffEscape(p.Name+" - "+p.ShortDesc))
+	} else {
+		page = append(page, roffEscape(p.Name))
+	}
+	page = append(page, ".SH SYNOPSIS", roffEscape(usage))
+	if flags := helpFlags(p.Flags()); len(flags) > 0 {
+		page = append(page, ".SH OPTIONS")
+		page = append(page, manFlags(flags)...)
+	}
+	var commands []string
+	p.Walk(func(cmd *Command, depth int) {
+		if depth == 0 || cmd.hidden {
+			return
+		}
+		commands = append(commands, fmt.Sprintf(".SS %v", roffEscape(synopsis(cmd))))
+		if cmd.LongDesc != "" {
+			commands = append(commands, roffEscape(cmd.LongDesc))
+		}
+		commands = append(commands, manFlags(helpFlags(cmd.Flags()))...)
+	})
+	if len(commands) > 0 {
+		page = append(page, ".SH COMMANDS")
+		page = append(page, commands...)
+	}
+	_, err = fmt.Fprintln(w, strings.Join(page, "\n"))
+	return err
+}
+
+//Builds the tagged paragraphs describing the flags
+func manFlags(flags []Flag) []string {
+	lines := make([]string, 0, 3*len(flags))
+	for _, f := range flags {
+		lines = append(lines, ".TP", `\fB`+roffEscape(strings.TrimLeft(f.FlagStringPrefix(), " "))+`\fR`)
+		if f.LongDesc != "" {
+			lines = append(lines, roffEscape(f.LongDesc))
+		}
+	}
+	return lines
+}
+
+//Escapes the text so roff takes it literally
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,51 @@
+package subcommand
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGenerateManPage(t *testing.T) {
+	parser := NewParser("prog")
+	parser.ShortDesc = "does things"
+	parser.AddSwitch("verbose", "v", "Talks a lot", emptyFn)
+	parser.AddSwitch("debug", "", "Internal", emptyFn).Hidden(true)
+	cmd := parser.AddCommand("copy", "Copies", "Copies the files.\n.Really", emptyFnMult)
+	cmd.SetArity(2, "SRC DST")
+	cmd.AddOption("mode", "m", "File mode", "", "MODE", emptyFn)
+	parser.AddCommand("secret", "", "", emptyFnMult).Hidden(true)
+
+	buf := new(bytes.Buffer)
+	if err := parser.GenerateManPage(buf); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := `.TH PROG 1
+.SH NAME
+prog \- does things
+.SH SYNOPSIS
+prog [GLOBAL_OPTIONS] command [COMMAND_OPTIONS] [PARAMS]
+.SH OPTIONS
+.TP
+\fB\-v,\-\-verbose\fR
+Talks a lot
+.SH COMMANDS
+.SS copy SRC DST
+Copies the files.
+\&.Really
+.TP
+\fB\-m,\-\-mode MODE\fR
+File mode
+`
+	if res := buf.String(); res != expected {
+		t.Errorf("Wrong man page:\n%v", res)
+	}
+}
+
+func TestRoffEscape(t *testing.T) {
+	if res := roffEscape(`a\b-c` + "\n'quote"); res != `a\eb\-c`+"\n"+`\&'quote` {
+		t.Errorf("Wrong escaping %q", res)
+	}
+	if res := roffEscape("no specials"); res != "no specials" {
+		t.Errorf("Wrong escaping %q", res)
+	}
+}
@@ -1,21 +1,88 @@
 package subcommand
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+//Writer where the parsing warnings are written to unless the parser sets its own (see Parser.SetErrorOutput)
+var errOutput io.Writer = os.Stderr
+
+//ErrorHandling defines how the parser behaves when the parsing process fails
+type ErrorHandling int
+
+const (
+	//Return the error
+	ContinueOnError ErrorHandling = iota
+	//Write the error and the help of the command where it was found to the output, then return it
+	PrintUsage
+	//Write the error and the help as PrintUsage and exit with status 2
+	ExitOnError
+)
+
+//Used to exit with ExitOnError
+var exit = os.Exit
+
 //Parser contains other commands. It's the data structure and its name should be the program's name.
+//Once configured, Parse can be called concurrently: the state of every parsing process is kept apart
+//and the flag values are published when it's over. The command and flag functions must be safe for
+//concurrent use themselves
 type Parser struct {
 	Command
 	Commands map[string]*Command
 	help     Command
+	//there is no help command
+	noHelp bool
+	//resolve unambiguous command prefixes
+	abbreviations bool
+	//flags visited during the last parsing process
+	visited []VisitedFlag
+	//commands executed during the last parsing process
+	executed []ExecutedCommand
+	//check all the arguments before calling any function
+	collectErrors bool
+	//recognise --help and -h
+	helpFlag bool
+	//text shown at the end of the help
+	epilog string
+	//program version printed by --version and -V
+	version string
+	//reject the top level arguments that are not a command
+	strictCommands bool
+	//called with the top level arguments that are not a command
+	unknownCommandFn CommandFunction
+	//what to do when the parsing fails
+	errorHandling ErrorHandling
+	//the first leftover ends the flags and commands
+	posix bool
+	//pass the unknown flags as leftovers
+	unknownFlags bool
+	//expand the @file arguments
+	responseFiles bool
+	//flag values by command used when the flags are not present in the arguments
+	defaults map[string]map[string]string
+	//writer where the help, the version and the errors are written to
+	out io.Writer
+	//when the help is colored
+	color ColorMode
 }
 
 //Sets the help command. There is one default implementation automatically added when the parser is created.
 func (p *Parser) SetHelp(name string, description string, fn CommandFunction) *Command {
 	command := newCommand(&p.Command, name, description, "", fn)
 	p.help = *command
+	p.noHelp = false
 	return command
 
 }
@@ -23,8 +90,33 @@ func (p *Parser) SetHelp(name string, description string, fn CommandFunction) *C
 //First level execution when parsing. The passed function is exectued taking the leftovers until the first command
 //./prog -switch left1 left2 command
 //in this case name will be prog, and left overs left1 and left2
+//The flags are called before it and they must precede the left overs. Any number of left overs is
+//accepted unless SetArity restricts them, before or after calling OnCommand
 func (p *Parser) OnCommand(fn CommandFunction) {
 	p.fn = fn
+	p.ctxFn = nil
+	p.acceptLeftOvers()
+}
+
+//lets the parser accept any number of left overs, unless its arity was set already
+func (p *Parser) acceptLeftOvers() {
+	if p.arity == newArity(0, "") {
+		p.arity = newArity(-1, "")
+	}
+}
+
+//OnUnknownCommand sets the function called when the first top level argument is not a command,
+//instead of passing it to the parser function. It receives the argument as the command name and the
+//arguments after it, for instance to run an external prog-name program as git does. The parser
+//function is still called, without arguments. StrictCommands takes precedence
+func (p *Parser) OnUnknownCommand(fn CommandFunction) {
+	p.unknownCommandFn = fn
+}
+
+//OnCommandCtx works as OnCommand for functions receiving the context passed to ParseContext
+func (p *Parser) OnCommandCtx(fn CommandFunctionCtx) {
+	p.ctxFn = fn
+	p.acceptLeftOvers()
 }
 
 //Execute this function once the flags have been consumed. This can be used to dinamically
@@ -33,17 +125,259 @@ func (p *Parser) PostFlags(fn func() error) {
 	p.postFlagsFn = fn
 }
 
-//NewParser constructs a parser for program name given
-func NewParser(program string) *Parser {
+//AllowAbbreviations enables prefix matching for commands. When enabled a command can be invoked
+//by any unambiguous prefix of its name (./prog stat for status). Exact names always win and
+//ambiguous prefixes produce an error listing the candidates.
+//Prefixes are only resolved for the first command of the command line so the positional
+//arguments of a command are never mistaken for commands.
+func (p *Parser) AllowAbbreviations(allow bool) {
+	p.abbreviations = allow
+}
+
+//AllowFlagAbbreviations makes the parser accept unambiguous prefixes of the long flags, so --verb
+//is taken as --verbose. An exact match always wins, and an ambiguous prefix is reported listing
+//the candidates
+func (p *Parser) AllowFlagAbbreviations(allow bool) {
+	p.flagPrefixes = allow
+}
+
+//AllowMultiCharShorts allows short definitions longer than one character (-ab) as older versions did.
+//Such definitions collide with clusters of short switches, so they are rejected by default.
+//It has to be called before adding the flags
+func (p *Parser) AllowMultiCharShorts(allow bool) {
+	p.multiCharShorts = allow
+}
+
+//CaseInsensitive makes flags and commands match regardless of their case, --Verbose is then
+//the same as --verbose. Definitions differing only in case are considered duplicates.
+//It has to be called before adding flags and commands
+func (p *Parser) CaseInsensitive(isIt bool) {
+	p.caseInsensitive = isIt
+}
+
+//CollectErrors makes the parser check all the arguments before calling any function. Unknown flags,
+//missing values, missing mandatory flags, wrong arities and failed validations are reported together
+//as ParsingErrors, and no function is called if any is found. The consumers of the flags added with
+//AddConsumerFlag are called while checking though, and commands added by PostFlags functions are not
+//known then
+func (p *Parser) CollectErrors(collect bool) {
+	p.collectErrors = collect
+}
+
+//DisableHelp removes the help command, help is treated as any other argument then. The --help and
+//-h flags are not recognised either. SetHelp adds a help command again
+func (p *Parser) DisableHelp() {
+	p.help = Command{}
+	p.noHelp = true
+}
+
+//Epilog sets the text shown at the end of the parser help, after the commands and the examples
+func (p *Parser) Epilog(text string) {
+	p.epilog = text
+}
+
+//SetHelpFlag enables or disables the built-in --help and -h switches, enabled by default. When found
+//at any position the help of the current command is printed and the parsing process stops without
+//further checks or executions. Flags with the same names defined by the user take precedence
+func (p *Parser) SetHelpFlag(enabled bool) {
+	p.helpFlag = enabled
+}
+
+//SetDefaultCommand sets the command executed when no command is found in the arguments, after the
+//parser function, so "prog" is the same as "prog status". The parser's leftovers are passed to the
+//default command instead
+func (p *Parser) SetDefaultCommand(name string) {
+	p.defaultCommand = name
+}
+
+//LoadDefaults reads the flag defaults from a JSON object. The global flags are given by their long
+//name and the command flags within an object named as the command:
+//{"verbose": true, "level": 3, "commit": {"message": "wip"}}
+//The defaults are used when the flags are not present in the arguments nor in the environment, and
+//take precedence over the ones set with Flag.Default. Unknown flags or commands are reported as errors
+func (p *Parser) LoadDefaults(r io.Reader) error {
+	var object map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&object); err != nil {
+		return p.errorf("defaults: %v", err)
+	}
+	defaults := make(map[string]map[string]string)
+	for key, value := range object {
+		if cmd, ok := p.Commands[p.key(key)]; ok {
+			if flags, ok := value.(map[string]interface{}); ok {
+				if err := addDefaults(defaults, *cmd, flags); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := addDefaults(defaults, p.Command, map[string]interface{}{key: value}); err != nil {
+			return err
+		}
+	}
+	p.defaults = defaults
+	return nil
+}
+
+//adds the defaults for the flags of the command
+func addDefaults(defaults map[string]map[string]string, command Command, flags map[string]interface{}) error {
+	if defaults[defaultsKey(command)] == nil {
+		defaults[defaultsKey(command)] = make(map[string]string)
+	}
+	for name, value := range flags {
+		if _, ok := command.innerFlagsLong[command.key(name)]; !ok {
+			return command.errorf("defaults: --%v is not a valid flag for %v", name, command.Name)
+		}
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case bool:
+			str = strconv.FormatBool(v)
+		case float64:
+			str = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return command.errorf("defaults: invalid value %v for --%v", value, name)
+		}
+		defaults[defaultsKey(command)][command.key(name)] = str
+	}
+	return nil
+}
+
+//the defaults of the parser flags are kept apart from the commands'
+func defaultsKey(command Command) string {
+	if command.parent == nil {
+		return ""
+	}
+	return command.key(command.Name)
+}
+
+//ExpandResponseFiles makes the parser replace the @file arguments with the arguments read from the
+//file before parsing. The arguments are separated by spaces or new lines, and quoted with ' or " to
+//include spaces. Response files can't reference other response files
+func (p *Parser) ExpandResponseFiles(expand bool) {
+	p.responseFiles = expand
+}
+
+//AllowUnknownFlags passes the unknown flags through as leftovers instead of failing, so they can be
+//forwarded to another program. The argument following an unknown flag goes with it unless it's a
+//flag or a command
+func (p *Parser) AllowUnknownFlags(allow bool) {
+	p.unknownFlags = allow
+}
+
+//PosixMode makes the first leftover of a command end the flags as POSIX utilities do: the
+//arguments after it are leftovers too, even if they start with - or name a command
+func (p *Parser) PosixMode(isIt bool) {
+	p.posix = isIt
+}
+
+//SetOutput sets the writer where the help, the version and the errors reported with
+//SetErrorHandling are written to, the standard output by default
+func (p *Parser) SetOutput(w io.Writer) {
+	p.out = w
+}
+
+//SetErrorOutput sets the writer where the parsing warnings, as the ones about deprecated flags, are
+//written to, the standard error by default
+func (p *Parser) SetErrorOutput(w io.Writer) {
+	p.errOut = w
+}
+
+//SetColor sets when the help highlights the command and flag names, ColorNever by default. With
+//ColorAuto they are highlighted if the output is a terminal
+func (p *Parser) SetColor(mode ColorMode) {
+	p.color = mode
+}
+
+//returns the writer set with SetOutput or the default one
+func (p *Parser) writer() io.Writer {
+	if p.out != nil {
+		return p.out
+	}
+	return output
+}
+
+//returns the writer set with Parser.SetErrorOutput or the default one
+func (c Command) errorWriter() io.Writer {
+	if root := c.root(); root.errOut != nil {
+		return root.errOut
+	}
+	return errOutput
+}
+
+//SetErrorHandling sets how the parser behaves when the parsing process fails, ContinueOnError by default
+func (p *Parser) SetErrorHandling(mode ErrorHandling) {
+	p.errorHandling = mode
+}
+
+//StrictCommands makes the parser fail with an UnknownCommandError when a top level argument is not a
+//command instead of passing it as a parameter to the parser function
+func (p *Parser) StrictCommands(strict bool) {
+	p.strictCommands = strict
+}
+
+//SetVersion sets the program version and enables the built-in --version and -V switches, which print
+//"program version X" and stop the parsing process as the help flag does
+func (p *Parser) SetVersion(version string) {
+	p.version = version
+}
+
+//ParserOption configures the parser built by NewParser
+type ParserOption func(*Parser)
+
+//WithHelpName names the help command, help by default
+func WithHelpName(name string) ParserOption {
+	return func(p *Parser) {
+		p.help.Name = name
+	}
+}
+
+//WithoutHelp builds the parser without help command, help is treated as any other argument then.
+//The --help and -h flags are not recognised either
+func WithoutHelp() ParserOption {
+	return func(p *Parser) {
+		p.DisableHelp()
+	}
+}
+
+//NewParser constructs a parser for program name given, configured by the options
+func NewParser(program string, options ...ParserOption) *Parser {
 	parser := &Parser{
 		Command:  *newCommand(nil, program, "", "", func(string, ...string) error { return nil }),
 		Commands: make(map[string]*Command),
+		helpFlag: true,
+	}
+	parser.Command.arity = newArity(0, "")
+	parser.help.Name = "help"
+	for _, option := range options {
+		option(parser)
+	}
+	if parser.noHelp {
+		return parser
 	}
-	parser.Command.arity = Arity{0, ""}
-	parser.SetHelp("help", fmt.Sprintf("Type %v help [command] for detailed information about a command", program), defaultHelp(*parser))
+	name := parser.help.Name
+	parser.SetHelp(name, fmt.Sprintf("Type %v %v [command] for detailed information about a command", program, name), defaultHelp(parser))
 	return parser
 }
 
+//checks if the argument names the help command
+func (p *Parser) isHelp(arg string) bool {
+	return !p.noHelp && p.key(arg) == p.key(p.help.Name)
+}
+
+//AddCommandCtx works as AddCommand for functions receiving the context passed to ParseContext
+func (p *Parser) AddCommandCtx(name string, shortDesc string, longDesc string, fn CommandFunctionCtx) *Command {
+	command := p.AddCommand(name, shortDesc, longDesc, func(string, ...string) error { return nil })
+	command.ctxFn = fn
+	return command
+}
+
+//AddHandler works as AddCommand calling the Run method of h, so the command can be handled by a
+//type keeping its own state
+func (p *Parser) AddHandler(name, description string, h CommandHandler) *Command {
+	return p.AddCommand(name, description, "", h.Run)
+}
+
 //AddCommand inserts a new subcommand to the parser. The callback fn receives as first argument
 //the command name followed by the left overs of the parsing process
 //Example:
@@ -56,89 +390,360 @@ func NewParser(program string) *Parser {
 //      }
 //}
 func (p *Parser) AddCommand(name string, shortDesc string, longDesc string, fn CommandFunction) *Command {
-	if _, exists := p.Commands[name]; exists {
+	if _, exists := p.Commands[p.key(name)]; exists {
 		panic(fmt.Sprintf("Command '%s' already exists ", name))
 	}
 	//create the command
 	command := newCommand(&p.Command, name, shortDesc, longDesc, fn)
 	//add it to the parser
-	p.Commands[name] = command
+	p.Commands[p.key(name)] = command
 	return command
 }
 
+//AddGlobalOption adds an option to the parser marked as global (see Flag.Global)
+func (p *Parser) AddGlobalOption(long, short, shortDesc, longDesc, values string, fn FlagFunction) *Flag {
+	return p.AddOption(long, short, shortDesc, longDesc, values, fn).Global(true)
+}
+
+//AddGlobalSwitch adds a switch to the parser marked as global (see Flag.Global)
+func (p *Parser) AddGlobalSwitch(long string, short string, shortDesc string, fn FlagFunction) *Flag {
+	return p.AddSwitch(long, short, shortDesc, fn).Global(true)
+}
+
+//CommandList returns the commands added to the parser sorted by name. The help command is not included
+func (p *Parser) CommandList() []*Command {
+	commands := make([]*Command, 0, len(p.Commands))
+	for _, cmd := range p.Commands {
+		commands = append(commands, cmd)
+	}
+	sort.Sort(byName(commands))
+	return commands
+}
+
+//LookupCommand returns the command with the given name as it would be found in the arguments, with
+//prefix matching when abbreviations are allowed. Ambiguous or unknown names return false
+func (p *Parser) LookupCommand(name string) (*Command, bool) {
+	cmd, ok, err := p.lookupCommand(name, p.Command)
+	if err != nil {
+		return nil, false
+	}
+	return cmd, ok
+}
+
+//Walk visits the command tree depth first starting with the parser's command at depth 0, followed
+//by its commands sorted by name at depth 1. Hidden commands are visited too (see Command.IsHidden),
+//the help command is not
+func (p *Parser) Walk(fn func(cmd *Command, depth int)) {
+	fn(&p.Command, 0)
+	for _, cmd := range p.CommandList() {
+		fn(cmd, 1)
+	}
+}
+
 //Parse parses the arguments executing the associated functions for each command and flag.
-//It returns the left overs if some non-option strings or commands  were not processed.
+//It returns the left overs of the parser's command, the arguments before the first command that are
+//not a flag, as passed to its function. It only accepts them with an arity (see OnCommand).
 //Errors are returned in case an unknown flag is found or a mandatory flag was not supplied.
 // The set of function calls to be performed are carried in order and once the parsing process is done
+//No arguments (an empty or nil slice) just execute the parser function, once the mandatory flags are checked
 func (p *Parser) Parse(args []string) (leftOvers []string, err error) {
-	err = p.parse(args, p.Command)
-	if err != nil {
-		return
+	return p.ParseContext(context.Background(), args)
+}
+
+//ParseContext works as Parse passing ctx to the functions registered with context support
+//(AddCommandCtx, AddOptionCtx...). No more commands are executed once ctx is done
+func (p *Parser) ParseContext(ctx context.Context, args []string) (leftOvers []string, err error) {
+	defer func() { err = p.handleError(err) }()
+	if words, ok := p.completeArgs(args); ok {
+		return nil, p.printCompletion(words)
+	}
+	if p.responseFiles {
+		if args, err = p.expandResponseFiles(args); err != nil {
+			return nil, err
+		}
+	}
+	run := &parsing{ctx: ctx, values: make(map[*Flag]string), counts: make(map[*Flag]int), defaults: p.defaults}
+	//check the arguments before calling any function
+	if p.collectErrors {
+		check := &parsing{ctx: ctx, dryRun: true, defaults: p.defaults}
+		p.parse(args, &p.Command, check)
+		if len(check.errs) > 0 {
+			p.publish(run)
+			return nil, ParsingErrors(check.errs)
+		}
 	}
+	if err = p.parse(args, &p.Command, run); err == nil {
+		leftOvers = rootLeftOvers(run.executed, &p.Command)
+	}
+	p.publish(run)
 	return
 }
 
+//returns the leftovers of the parser's command among the executed commands
+func rootLeftOvers(executed []ExecutedCommand, root *Command) []string {
+	for _, ex := range executed {
+		if ex.Command == root {
+			return ex.LeftOvers
+		}
+	}
+	return nil
+}
+
+//ParseScript runs Parse for every line read from r, as if each one was a separate invocation of the
+//program. Lines are split in arguments as the response files are, blank lines and lines starting
+//with # are skipped. It stops at the first failing line returning a ScriptError, the leftovers are
+//ignored
+func (p *Parser) ParseScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		args, err := splitArgs(text)
+		if err != nil {
+			return p.handleError(ScriptError{line, p.errorf("%v", err)})
+		}
+		if _, err := p.Parse(args); err != nil {
+			return ScriptError{line, err}
+		}
+	}
+	return scanner.Err()
+}
+
+//Reset clears the results of the last parsing process: the flag values, the visited flags and the
+//executed commands. The commands and flags stay registered. Every Parse starts afresh anyway, Reset
+//is useful to drop the results once they have been handled
+func (p *Parser) Reset() {
+	p.publish(&parsing{})
+}
+
+//ExecutionPlan is what a parsing process would execute
+type ExecutionPlan struct {
+	//Commands that would be executed, from the parser itself to the deepest one, with their leftovers
+	Commands []ExecutedCommand
+	//Flags that would be set in the order they were found, the ones from the environment and the
+	//defaults included
+	Flags []VisitedFlag
+}
+
+//Plan checks the arguments as Parse does, returning what would be executed without calling any
+//function but the consumers of the flags added with AddConsumerFlag, as they tell how many arguments
+//the flags take. The deprecated flags are not warned about. The commands added by the functions (see
+//PostFlags) are unknown. The results of the last parsing process are not modified. All the errors
+//found are returned as ParsingErrors when CollectErrors is set, the first one otherwise
+func (p *Parser) Plan(args []string) (*ExecutionPlan, error) {
+	if p.responseFiles {
+		var err error
+		if args, err = p.expandResponseFiles(args); err != nil {
+			return nil, err
+		}
+	}
+	run := &parsing{ctx: context.Background(), dryRun: true, defaults: p.defaults}
+	p.parse(args, &p.Command, run)
+	if len(run.errs) > 0 {
+		if p.collectErrors {
+			return nil, ParsingErrors(run.errs)
+		}
+		return nil, run.errs[0]
+	}
+	return &ExecutionPlan{run.executed, run.visited}, nil
+}
+
+//MustParse works as Parse but panics if an error is found during the parsing process,
+//returning just the left overs otherwise
+func (p *Parser) MustParse(args []string) []string {
+	leftOvers, err := p.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	return leftOvers
+}
+
+//ParseCommandLine parses the program's command line arguments, os.Args without the program name
+func (p *Parser) ParseCommandLine() (leftOvers []string, err error) {
+	return p.ParseFrom(os.Args, true)
+}
+
+//ParseFrom parses the arguments skipping the first one, the program name, if skipProgram is true.
+//Use it to pass os.Args as it is, Parse expects the arguments without the program name
+func (p *Parser) ParseFrom(args []string, skipProgram bool) (leftOvers []string, err error) {
+	if skipProgram && len(args) > 0 {
+		args = args[1:]
+	}
+	return p.Parse(args)
+}
+
 //The actual parsing process
-func (p *Parser) parse(args []string, currentCommand Command) (err error) {
+func (p *Parser) parse(args []string, currentCommand *Command, run *parsing) (err error) {
 	//TODO : rewrite the parsing algorithm to make it a bit more clean and clever...
 	//visited flags
 	var flagsToCall []flagCallable
 	var leftOvers []string
+	//the leftovers counted by the arity, the unknown flags passed through are left out
+	var params []string
 	var nextCommandCall func() error
+	//the flags are called once, when the first leftover or command is found
+	flagsCalled := false
 	i := 0
 	//functions to call once the parsing process is over
 	//go comsuming options commands and sub-options
 	for ; i < len(args); i++ {
 		arg := args[i]
-		if strings.HasPrefix(arg, "-") { //flag
-			var fCallable flagCallable
-			fCallable, i, err = currentCommand.parseFlag(args, i)
-			flagsToCall = append(flagsToCall, fCallable)
-			if err != nil {
+		//in posix mode the first leftover ends the flags
+		if p.posix && flagsCalled {
+			leftOvers = append(leftOvers, arg)
+			params = append(params, arg)
+			continue
+		}
+		flagArg, isFlagArg := currentCommand.flagForm(arg)
+		if builtin, ok := p.builtinFlag(flagArg, *currentCommand); isFlagArg && ok { //print the help or version and stop
+			if run.dryRun {
+				return nil
+			}
+			return builtin()
+		}
+		if isFlagArg { //flag
+			var fCallables []flagCallable
+			flagPos := i
+			flagArgs := args
+			if flagArg != arg { //the flag is parsed in its -f or --flag form
+				flagArgs = append([]string(nil), args...)
+				flagArgs[i] = flagArg
+			}
+			fCallables, i, err = currentCommand.parseFlag(flagArgs, i, run)
+			if flagArg != arg {
+				err = p.asTyped(err, arg)
+			}
+			if _, unknown := err.(UnknownFlagError); unknown && p.unknownFlags {
+				leftOvers = append(leftOvers, arg)
+				if p.passThroughValue(args, i, *currentCommand) {
+					i++
+					leftOvers = append(leftOvers, args[i])
+				}
+				err = nil
+				continue
+			}
+			//the flags were called when the first leftover was found
+			if err == nil && flagsCalled {
+				err = currentCommand.errorf("%v: flag %v found after the arguments %v, flags must precede them",
+					currentCommand.Name, arg, leftOvers)
+			}
+			flagsToCall = append(flagsToCall, fCallables...)
+			if err = run.fail(currentCommand.annotate(positioned(err, run.offset))); err != nil {
 				return
 			}
+			if builtin, ok := p.builtinValue(args[flagPos+1:i+1], fCallables, *currentCommand); ok {
+				if run.dryRun {
+					return nil
+				}
+				return builtin()
+			}
 
 		} else { //command or leftover
 			//call the flags (make sure we call it just once
-			if len(leftOvers) == 0 {
-				if err = currentCommand.callFlags(flagsToCall); err != nil {
+			if !flagsCalled {
+				flagsCalled = true
+				//the built-in flags of the command found are handled straight away, the flags before it
+				//are neither checked nor called
+				if next, ok := p.builtinAhead(args[i:], *currentCommand); ok {
+					run.offset += i + 1
+					return p.parse(args[i+1:], next, run)
+				}
+				//the arity is checked before calling any function, unless the leftovers can't be told
+				//before parsing them: the parser leftovers may go to other commands and the unknown
+				//flags are passed as leftovers
+				if !run.dryRun && !p.unknownFlags && currentCommand.Name != p.Command.Name && currentCommand.Name != p.help.Name {
+					if err = currentCommand.annotate(currentCommand.checkArity(p.leftOversAhead(args[i:], *currentCommand), p)); err != nil {
+						return
+					}
+				}
+				//the flags given after the command name are not taken from the fallbacks
+				ahead := p.flagsAhead(args[i:], currentCommand)
+				if err = run.fail(currentCommand.annotate(currentCommand.callFlags(flagsToCall, ahead, run))); err != nil {
 					return
 				}
 			}
 
-			cmd, isCommand := p.Commands[arg]
+			var cmd *Command
+			var isCommand bool
+			cmd, isCommand, err = p.lookupCommand(arg, *currentCommand)
+			if err = run.fail(err); err != nil {
+				return
+			}
 			//if its a command or help
-			if isHelp := (arg == p.help.Name); (isCommand || isHelp) && currentCommand.Name != p.help.Name {
+			if isHelp := p.isHelp(arg); (isCommand || isHelp) && currentCommand.Name != p.help.Name {
 				nextCommandCall = func() error {
 					i := i
 					if isHelp {
 						cmd = &(p.help)
 					}
+					run.offset += i + 1
 					//call with the rest of the args
-					err := p.parse(args[i+1:], *cmd)
+					err := p.parse(args[i+1:], cmd, run)
 					if err != nil {
 						return err
 					}
 					return nil
 				}
 
+				break
+			} else if p.strictCommands && currentCommand.Name == p.Command.Name {
+				return run.fail(UnknownCommandError{arg, *currentCommand, p.suggestCommand(arg)})
+			} else if p.unknownCommandFn != nil && currentCommand.Name == p.Command.Name && len(leftOvers) == 0 {
+				rest := args[i+1:]
+				nextCommandCall = func() error {
+					if run.dryRun {
+						return nil
+					}
+					return p.unknownCommandFn(arg, rest...)
+				}
 				break
 			} else {
 				leftOvers = append(leftOvers, arg)
+				params = append(params, arg)
 			}
 
 		}
 
 	}
-	//call the flags
-	if nextCommandCall == nil && len(leftOvers) == 0 {
-		if err = currentCommand.callFlags(flagsToCall); err != nil {
+	//call the flags, checking first the arity when they weren't called yet. Once a leftover is found
+	//they are called straight away, as they could add the next command (see PostFlags)
+	if !flagsCalled {
+		if nextCommandCall == nil && !run.dryRun {
+			if err = currentCommand.annotate(currentCommand.checkArity(params, p)); err != nil {
+				return
+			}
+		}
+		if err = run.fail(currentCommand.annotate(currentCommand.callFlags(flagsToCall, nil, run))); err != nil {
 			return
 		}
 	}
+	//no command found, the leftovers go to the default one
+	if nextCommandCall == nil && currentCommand.Name == p.Command.Name && p.defaultCommand != "" {
+		cmd, ok := p.Commands[p.key(p.defaultCommand)]
+		if !ok {
+			return run.fail(currentCommand.errorf("%v: default command not found %v", currentCommand.Name, p.defaultCommand))
+		}
+		rest := leftOvers
+		leftOvers, params = nil, nil
+		nextCommandCall = func() error {
+			return p.parse(rest, cmd, run)
+		}
+	}
 	//call current command
-	if err = currentCommand.exec(leftOvers, *p); err != nil {
+	if run.dryRun {
+		if err := currentCommand.annotate(currentCommand.checkArity(params, p)); err != nil {
+			run.fail(err)
+		} else {
+			run.executed = append(run.executed, ExecutedCommand{currentCommand, leftOvers})
+		}
+	} else if err = currentCommand.annotate(currentCommand.checkArity(params, p)); err != nil {
+		return
+	} else if err = currentCommand.annotate(currentCommand.execContext(run.ctx, leftOvers, p)); err != nil {
 		return
+	} else {
+		run.executed = append(run.executed, ExecutedCommand{currentCommand, leftOvers})
 	}
 	//look for next command
 	if nextCommandCall != nil {
@@ -147,36 +752,486 @@ func (p *Parser) parse(args []string, currentCommand Command) (err error) {
 	return nil
 }
 
+//SetFlagPrefix sets the prefixes of the long and the short flags, -- and - by default. They can be
+//the same (/flag and /f), then the long flags take precedence over the short ones and their clusters.
+//The help and the completion scripts show the default prefixes
+func (p *Parser) SetFlagPrefix(long, short string) {
+	if long == "" || short == "" {
+		panic("Flag prefixes can't be empty")
+	}
+	p.longPrefix, p.shortPrefix = long, short
+}
+
+//decides if the argument is a flag, returning it in its -f or --flag form if the flag prefixes are
+//not the default ones. Numbers are flags only when registered as such (-1), negative numbers otherwise
+func (c Command) flagForm(arg string) (string, bool) {
+	root := c.root()
+	if root.longPrefix == "" {
+		return arg, strings.HasPrefix(arg, "-") && (!isNegativeNumber(arg) || c.isFlag(arg))
+	}
+	if name := strings.TrimPrefix(arg, root.longPrefix); name != arg && name != "" {
+		if root.longPrefix == root.shortPrefix && !c.isFlag("--"+name) && c.isFlag("-"+name) {
+			return "-" + name, true
+		}
+		return "--" + name, true
+	}
+	if name := strings.TrimPrefix(arg, root.shortPrefix); name != arg && name != "" {
+		return "-" + name, !isNegativeNumber("-"+name) || c.isFlag("-"+name)
+	}
+	return arg, false
+}
+
+//checks if the argument is a flag known by the command as typed with the flag prefixes, so it's not
+//taken as the value of the flag before it (--output --verbose)
+func (c Command) isTypedFlag(arg string) bool {
+	form, ok := c.flagForm(arg)
+	return ok && c.isFlag(form)
+}
+
+//restores the flag as typed in the arguments in the errors about it
+func (p *Parser) asTyped(err error, arg string) error {
+	switch e := err.(type) {
+	case UnknownFlagError:
+		e.Flag = arg
+		if e.Suggestion != "" {
+			e.Suggestion = p.longPrefix + strings.TrimPrefix(e.Suggestion, "--")
+		}
+		return e
+	case MissingValueError:
+		e.Flag = arg
+		return e
+	}
+	return err
+}
+
+//replaces the @file arguments with the contents of the files
+func (p *Parser) expandResponseFiles(args []string) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			expanded = append(expanded, arg)
+			continue
+		}
+		content, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, p.errorf("response file %v: %v", arg[1:], err)
+		}
+		fileArgs, err := splitArgs(string(content))
+		if err != nil {
+			return nil, p.errorf("response file %v: %v", arg[1:], err)
+		}
+		for _, fileArg := range fileArgs {
+			if strings.HasPrefix(fileArg, "@") && len(fileArg) > 1 {
+				return nil, p.errorf("response file %v: nested response file %v not allowed", arg[1:], fileArg)
+			}
+		}
+		expanded = append(expanded, fileArgs...)
+	}
+	return expanded, nil
+}
+
+//splits the text in arguments separated by white space, quotes group the text between them. A
+//backslash escapes the next character, except within single quotes where the text is taken as it is
+func splitArgs(text string) (args []string, err error) {
+	var arg []rune
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range text {
+		switch {
+		case escaped:
+			arg = append(arg, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("unterminated escape at the end")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return
+}
+
+//reports the error as set with SetErrorHandling, just the error without help command
+func (p *Parser) handleError(err error) error {
+	if err == nil || p.errorHandling == ContinueOnError {
+		return err
+	}
+	fmt.Fprintln(p.writer(), err)
+	p.helpFor(p.errorCommand(err))
+	if p.errorHandling == ExitOnError {
+		exit(2)
+	}
+	return err
+}
+
+//returns the command where the error was found, the parser's one if unknown
+func (p *Parser) errorCommand(err error) Command {
+	switch e := err.(type) {
+	case ParsingErrors:
+		return p.errorCommand(e[0])
+	case ParsingError:
+		return e.Command
+	case UnknownFlagError:
+		return e.Command
+	case MissingValueError:
+		return e.Command
+	case MissingMandatoryError:
+		return e.Command
+	case ArityError:
+		return e.Command
+	case ValidationError:
+		return e.Command
+	case FlagError:
+		return e.Command
+	case CommandError:
+		return e.Command
+	case ScriptError:
+		return p.errorCommand(e.Err)
+	case UnknownCommandError:
+		return e.Command
+	}
+	return p.Command
+}
+
+//replaces the flag values and visited flags of the previous parsing process with the ones of run
+func (p *Parser) publish(run *parsing) {
+	resultsLock.Lock()
+	defer resultsLock.Unlock()
+	commands := []*Command{&p.Command, &p.help}
+	for _, cmd := range p.Commands {
+		commands = append(commands, cmd)
+	}
+	for _, cmd := range commands {
+		for _, flag := range cmd.orderedFlags {
+			flag.result.value, flag.result.set, flag.result.count = "", false, 0
+		}
+	}
+	for flag, value := range run.values {
+		flag.result.value, flag.result.set, flag.result.count = value, true, run.counts[flag]
+	}
+	p.visited = run.visited
+	p.executed = run.executed
+}
+
+//state of a single parsing process
+type parsing struct {
+	ctx context.Context
+	//just check the arguments without calling any function, collecting the errors found
+	dryRun bool
+	errs   []error
+	//flags visited so far
+	visited []VisitedFlag
+	//values of the flags set so far
+	values map[*Flag]string
+	//times each flag was found so far
+	counts map[*Flag]int
+	//commands executed so far
+	executed []ExecutedCommand
+	//defaults loaded with Parser.LoadDefaults
+	defaults map[string]map[string]string
+	//position of the arguments being parsed within the whole arguments
+	offset int
+}
+
+//makes the position of the flag errors relative to the whole arguments
+func positioned(err error, offset int) error {
+	switch e := err.(type) {
+	case UnknownFlagError:
+		e.Pos += offset
+		return e
+	case MissingValueError:
+		e.Pos += offset
+		return e
+	}
+	return err
+}
+
+//returns the error unless just checking the arguments, then the error is collected
+func (run *parsing) fail(err error) error {
+	if run.dryRun && err != nil {
+		run.errs = append(run.errs, err)
+		return nil
+	}
+	return err
+}
+
+//returns the function for the built-in flags (--help, --version) if the argument is one of them.
+//Flags defined by the user take precedence
+func (p *Parser) builtinFlag(arg string, currentCommand Command) (func() error, bool) {
+	if currentCommand.isFlag(arg) {
+		return nil, false
+	}
+	if p.helpFlag && !p.noHelp && (arg == "--help" || arg == "-h") {
+		return func() error { return p.helpFor(currentCommand) }, true
+	}
+	if p.version != "" && (arg == "--version" || arg == "-V") {
+		return func() error {
+			_, err := fmt.Fprintf(p.writer(), "%v version %v\n", p.Name, p.version)
+			return err
+		}, true
+	}
+	return nil, false
+}
+
+//returns the leftovers of the command starting the arguments, up to the next command. The commands
+//added by the flag functions are not known yet (see PostFlags)
+func (p *Parser) leftOversAhead(args []string, currentCommand Command) (leftOvers []string) {
+	if p.posix {
+		return args
+	}
+	for _, arg := range args {
+		if _, isCommand, _ := p.lookupCommand(arg, currentCommand); isCommand || p.isHelp(arg) {
+			return
+		}
+		if _, isFlagArg := currentCommand.flagForm(arg); !isFlagArg {
+			leftOvers = append(leftOvers, arg)
+		}
+	}
+	return
+}
+
+//returns the flags of the command given after the command name that starts the arguments, as the
+//commands accept the flags of their parents (prog cmd --verbose)
+func (p *Parser) flagsAhead(args []string, owner *Command) (ahead []flagCallable) {
+	scope := owner
+	for i := 0; i < len(args); i++ {
+		arg, isFlagArg := scope.flagForm(args[i])
+		if !isFlagArg {
+			if cmd, ok, _ := p.lookupCommand(arg, *scope); ok {
+				scope = cmd
+			} else if p.posix {
+				return
+			}
+			continue
+		}
+		for _, flag := range scope.typedFlags(arg) {
+			if owner.owns(flag) {
+				ahead = append(ahead, flagCallable{flag: flag})
+			}
+		}
+		if opt := valueOption(arg, *scope); opt != nil {
+			i += opt.nargs
+		}
+	}
+	return
+}
+
+//returns the flags the argument stands for, several for a cluster of short switches
+func (c Command) typedFlags(arg string) []*Flag {
+	if strings.HasPrefix(arg, "--") {
+		name := arg[2:]
+		if idx := strings.Index(name, "="); idx > 0 {
+			name = name[:idx]
+		}
+		if opt := c.lookupNegated(name); opt != nil {
+			return []*Flag{opt}
+		}
+		if opt, _ := c.lookupLong(name); opt != nil {
+			return []*Flag{opt}
+		}
+		return nil
+	}
+	if opt, ok := c.lookupFlag(c.key(arg[1:]), false); ok {
+		return []*Flag{opt}
+	}
+	flags, _, _ := c.clusterFlags(arg)
+	return flags
+}
+
+//checks if the first argument is a command followed by one of the built-in flags (cmd --help),
+//returning the command
+func (p *Parser) builtinAhead(args []string, currentCommand Command) (*Command, bool) {
+	cmd, ok, _ := p.lookupCommand(args[0], currentCommand)
+	if !ok {
+		return nil, false
+	}
+	for _, arg := range args[1:] {
+		flagArg, isFlagArg := cmd.flagForm(arg)
+		if !isFlagArg {
+			if p.posix {
+				return nil, false
+			}
+			continue
+		}
+		if _, ok := p.builtinFlag(flagArg, *cmd); ok {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+//looks for the built-in flags among the values taken by an option, as --help or --version where a
+//value was expected is most likely a mistake (--output --help). Consumers decide on their own values
+func (p *Parser) builtinValue(values []string, callables []flagCallable, currentCommand Command) (func() error, bool) {
+	for _, callable := range callables {
+		if callable.flag.consumer != nil {
+			return nil, false
+		}
+	}
+	for _, value := range values {
+		if builtin, ok := p.builtinFlag(value, currentCommand); ok {
+			return builtin, true
+		}
+	}
+	return nil, false
+}
+
+//executes the help command for the given command, nothing is shown without help command
+func (p *Parser) helpFor(command Command) error {
+	if p.noHelp {
+		return nil
+	}
+	if command.Name == p.Command.Name || command.Name == p.help.Name {
+		return p.help.fn(p.help.Name)
+	}
+	return p.help.fn(p.help.Name, command.Name)
+}
+
+//Looks for the command with the given name, falling back to prefix matching when abbreviations are allowed
+func (p *Parser) lookupCommand(name string, currentCommand Command) (*Command, bool, error) {
+	name = p.key(name)
+	if cmd, ok := p.Commands[name]; ok {
+		return cmd, true, nil
+	}
+	if !p.abbreviations || currentCommand.Name != p.Command.Name {
+		return nil, false, nil
+	}
+	var candidates []string
+	for key, cmd := range p.Commands {
+		if strings.HasPrefix(key, name) {
+			candidates = append(candidates, cmd.Name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return p.Commands[p.key(candidates[0])], true, nil
+	}
+	sort.Strings(candidates)
+	return nil, false, currentCommand.errorf("%v: command %v is ambiguous (%v)",
+		currentCommand.Name, name, strings.Join(candidates, ", "))
+}
+
 //Execute the command function with leftovers as parameters
-func (c Command) exec(leftOvers []string, p Parser) error {
-	arity := c.Arity().Count
+func (c Command) exec(leftOvers []string, p *Parser) error {
+	if err := c.checkArity(leftOvers, p); err != nil {
+		return err
+	}
+	return c.execContext(context.Background(), leftOvers, p)
+}
+
+//Execute the command function passing ctx if it supports it, the arity is checked beforehand
+func (c Command) execContext(ctx context.Context, leftOvers []string, p *Parser) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	if c.ctxFn != nil {
+		err = c.ctxFn(ctx, c.Name, leftOvers...)
+	} else {
+		err = c.fn(c.Name, leftOvers...)
+	}
+	if err != nil {
+		return CommandError{c, err}
+	}
+	return nil
+}
+
+//checks the number of leftovers against the command arity
+func (c Command) checkArity(leftOvers []string, p *Parser) error {
 	//check correct number of params
-	if arity != -1 && arity != len(leftOvers) {
-		if c.Name == p.Command.Name {
-			return c.errorf("%v: subcommand not found %v",
-				c.Name, leftOvers[0])
+	if !c.Arity().Accepts(len(leftOvers)) {
+		//arguments for a parser accepting none are most likely mistyped commands
+		if c.Name == p.Command.Name && c.arity.Max == 0 {
+			return UnknownCommandError{leftOvers[0], c, p.suggestCommand(leftOvers[0])}
 		} else {
-			return c.errorf("Arity: Command %s accepts %v parameters but %v found (%v)",
-				c.Name, arity, len(leftOvers), leftOvers)
+			return ArityError{c, leftOvers}
 		}
 
 	}
-	if err := c.fn(c.Name, leftOvers...); err != nil {
+	return nil
+}
+
+//passes the error through the function set with OnError
+func (c Command) annotate(err error) error {
+	if err == nil || c.errorFn == nil {
 		return err
 	}
-	return nil
+	return c.errorFn(err)
 }
 
-//Call the each flag with the associated value
-func (c Command) callFlags(flagsToCall []flagCallable) error {
+//Call the each flag with the associated value, recording them as visited. The flags ahead, given
+//after the command name, are neither called nor taken from the fallbacks, and they count as present.
+//When just checking the arguments the errors are collected and no function is called
+func (c Command) callFlags(flagsToCall, ahead []flagCallable, run *parsing) error {
+	//fall back to the environment and defaults for the flags not present in the arguments
+	flagsToCall = append(flagsToCall, fallbackFlags(append(flagsToCall, ahead...), c, run.defaults)...)
 	//check if we got all the mandatory flags
-	if err := checkVisited(flagsToCall, c); err != nil {
+	present := append(append([]flagCallable(nil), flagsToCall...), ahead...)
+	if run.dryRun {
+		for _, err := range missingMandatory(present, c) {
+			run.fail(c.annotate(err))
+		}
+	} else if err := checkVisited(present, c); err != nil {
 		return err
 	}
-	//call flag functions
+	//validate the values before any function is called
 	for _, fc := range flagsToCall {
-		if err := fc.fn(); err != nil {
-			return err
+		for _, validate := range fc.flag.validators {
+			if err := validate(fc.value); err != nil {
+				verr := ValidationError{fc.flag.name(), fc.value, c, err}
+				if !run.dryRun {
+					return verr
+				}
+				run.fail(c.annotate(verr))
+				break
+			}
+		}
+	}
+	if run.dryRun {
+		for _, fc := range flagsToCall {
+			run.visited = append(run.visited, VisitedFlag{*fc.flag, fc.value, c.Name})
+		}
+		return nil
+	}
+	//call pre flags
+	if err := c.preFlagsFn(); err != nil {
+		return err
+	}
+	//keep the values until the parsing process is over
+	for _, fc := range flagsToCall {
+		run.values[fc.flag] = fc.value
+		run.counts[fc.flag]++
+		run.visited = append(run.visited, VisitedFlag{*fc.flag, fc.value, c.Name})
+	}
+	//call flag functions
+	for _, fc := range collapseRepeated(flagsToCall) {
+		if err := fc.fn(run.ctx); err != nil {
+			return FlagError{fc.flag.name(), c, err}
 		}
 
 	}
@@ -185,66 +1240,524 @@ func (c Command) callFlags(flagsToCall []flagCallable) error {
 }
 
 //convinience lambda to pass the flag function around
-func flagFunction(name, value string, fn FlagFunction) func() error {
-	return func() error { return fn(name, value) }
+func flagFunction(name, value string, short bool, flag *Flag) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if flag.ctxFn != nil {
+			return flag.ctxFn(ctx, name, value)
+		}
+		if flag.formFn != nil {
+			return flag.formFn(name, value, short)
+		}
+		if flag.fn == nil { //just recording the value
+			return nil
+		}
+		return flag.fn(name, value)
+	}
 }
 
 //contains the flag and its fucntion ready to call
 type flagCallable struct {
-	fn   func() error
-	flag Flag
+	fn    func(context.Context) error
+	flag  *Flag
+	value string
+}
+
+//builds the callable for the flag with the given value (empty for switches). short tells if the
+//flag was typed in its short form
+func newFlagCallable(flag *Flag, value string, short bool) flagCallable {
+	return flagCallable{flagFunction(flag.name(), value, short, flag), flag, value}
 }
 
-//parses a flag and returns a flag callable to execute and the new position of the args iterator
-func (c Command) parseFlag(args []string, pos int) (callable flagCallable, newPos int, err error) {
+//VisitedFlag is a flag found during the parsing process, either in the arguments or in the environment,
+//along with its value (empty for switches) and the command it belongs to
+type VisitedFlag struct {
+	Flag    Flag
+	Value   string
+	Command string
+}
+
+//ExecutedCommands returns the commands executed during the last parsing process, from the parser
+//itself to the deepest command found. The help command is included when it was executed
+func (p *Parser) ExecutedCommands() []*Command {
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	commands := make([]*Command, 0, len(p.executed))
+	for _, executed := range p.executed {
+		commands = append(commands, executed.Command)
+	}
+	return commands
+}
+
+//InvokedCommand returns the deepest command executed during the last parsing process, nil if only
+//the parser itself was. The help command is returned when it was executed as a command
+func (p *Parser) InvokedCommand() *Command {
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	if len(p.executed) == 0 {
+		return nil
+	}
+	if last := p.executed[len(p.executed)-1].Command; last != &p.Command {
+		return last
+	}
+	return nil
+}
+
+//ExecutedCommand is a command executed during the parsing process with the leftovers it received
+type ExecutedCommand struct {
+	Command   *Command
+	LeftOvers []string
+}
+
+//LeftOversByCommand returns the commands executed during the last parsing process, as
+//ExecutedCommands does, each one with its own leftovers
+func (p *Parser) LeftOversByCommand() []ExecutedCommand {
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	return p.executed
+}
+
+//VisitedFlags returns the flags visited during the last parsing process in the order they were found
+func (p *Parser) VisitedFlags() []VisitedFlag {
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+	return p.visited
+}
+
+//parses a flag and returns the flag callables to execute and the new position of the args iterator.
+//Several callables are returned when the argument is a cluster of short switches (-vvv)
+func (c Command) parseFlag(args []string, pos int, run *parsing) (callables []flagCallable, newPos int, err error) {
 	arg := args[pos]
 	newPos = pos
 	var opt *Flag
 	var ok bool
-	var fn func() error
+	var value string
+	//long flags can have its value after = (--option=value)
+	inline, hasInline := "", false
+	if idx := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && idx > 2 {
+		arg, inline, hasInline = arg[:idx], arg[idx+1:], true
+	}
 	//long or shor definition
 	if strings.HasPrefix(arg, "--") {
-		opt, ok = c.innerFlagsLong[arg[2:]]
+		if opt = c.lookupNegated(arg[2:]); opt != nil { //--no-flag
+			if hasInline {
+				err = c.errorf("%v doesn't accept a value", arg)
+				return
+			}
+			inline, hasInline = "false", true
+		} else if opt, err = c.lookupLong(arg[2:]); err != nil {
+			return
+		}
+		ok = opt != nil
 	} else {
-		opt, ok = c.innerFlagsShort[arg[1:]]
+		opt, ok = c.lookupFlag(c.key(arg[1:]), false)
+		if !ok && len(arg) > 2 {
+			if flags, value, cluster := c.clusterFlags(arg); cluster {
+				return c.parseCluster(args, pos, flags, value, run)
+			}
+		}
 	}
 	//not present
 	if !ok {
-		err = c.errorf("%v is not a valid flag for %v", arg, c.Name)
+		err = UnknownFlagError{Flag: arg, Command: c, Pos: pos}
+		if strings.HasPrefix(arg, "--") {
+			if suggestion := c.suggestFlag(arg[2:]); suggestion != "" {
+				err = UnknownFlagError{Flag: arg, Command: c, Suggestion: "--" + suggestion, Pos: pos}
+			}
+		}
+		return
+	}
+	c.warnDeprecated(*opt, arg, run)
+	if hasInline {
+		return c.inlineValue(opt, arg, inline, pos)
+	}
+	//options with an optional value take it only after = (--color=never)
+	if opt.hasOptional {
+		callables = []flagCallable{newFlagCallable(opt, opt.optionalValue, !strings.HasPrefix(arg, "--"))}
 		return
 	}
 
-	if opt.Type == Option { //option
-		if pos+1 >= len(args) {
-			err = c.errorf("No value for option %v", arg)
+	//the value is taken as it is, negative numbers (-5) included, unless it's a known flag
+	//as most likely the value was forgotten (--output --verbose)
+	if opt.consumer != nil {
+		var consumed int
+		if consumed, err = opt.consumer(opt.name(), args[pos+1:]); err != nil {
 			return
 		}
-		fn = flagFunction(opt.Long, args[pos+1], opt.fn)
-		newPos = pos + 1
-	} else { //switch
-		fn = flagFunction(opt.Long, "", opt.fn)
+		if consumed < 0 || consumed > len(args)-pos-1 {
+			err = c.errorf("%v consumed %v arguments out of %v", arg, consumed, len(args)-pos-1)
+			return
+		}
+		callables = []flagCallable{newFlagCallable(opt, strings.Join(args[pos+1:pos+1+consumed], " "), !strings.HasPrefix(arg, "--"))}
+		newPos = pos + consumed
+		return
+	}
+	//options with several values stop at the -- terminator, a single value is taken as it is
+	if opt.Type == Option { //option
+		values := make([]string, 0, opt.nargs)
+		for next := pos + 1; next <= pos+opt.nargs; next++ {
+			if next >= len(args) || c.isTypedFlag(args[next]) || (opt.nargs > 1 && args[next] == "--") {
+				err = MissingValueError{arg, c, pos}
+				return
+			}
+			values = append(values, args[next])
+		}
+		value = strings.Join(values, " ")
+		newPos = pos + opt.nargs
+	}
+	callables = []flagCallable{newFlagCallable(opt, value, !strings.HasPrefix(arg, "--"))}
+	return
+}
+
+var negativeNumber = regexp.MustCompile(`^-(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+//checks if the argument is a negative number (-5, -3.14) rather than a flag
+func isNegativeNumber(arg string) bool {
+	return negativeNumber.MatchString(arg)
+}
+
+//returns the bool flag negated by name (no-flag), unless a flag is defined with that very name
+func (c Command) lookupNegated(name string) *Flag {
+	if !strings.HasPrefix(name, "no-") {
+		return nil
+	}
+	if _, exists := c.lookupFlag(c.key(name), true); exists {
+		return nil
+	}
+	if opt, ok := c.lookupFlag(c.key(name[3:]), true); ok && opt.negatable {
+		return opt
+	}
+	return nil
+}
+
+//Looks for the long flag with the given name, falling back to prefix matching when flag abbreviations
+//are allowed. It returns nil if the flag is not found
+func (c Command) lookupLong(name string) (*Flag, error) {
+	if opt, ok := c.lookupFlag(c.key(name), true); ok {
+		return opt, nil
+	}
+	if !c.root().flagPrefixes || name == "" {
+		return nil, nil
+	}
+	candidates := make(map[string]*Flag)
+	for cmd := &c; cmd != nil; cmd = cmd.parent {
+		for key, opt := range cmd.innerFlagsLong {
+			//the command flags shadow the parent's
+			if _, exists := candidates[key]; !exists && strings.HasPrefix(key, c.key(name)) {
+				candidates[key] = opt
+			}
+		}
+	}
+	if len(candidates) > 1 {
+		names := make([]string, 0, len(candidates))
+		for _, opt := range candidates {
+			names = append(names, "--"+opt.Long)
+		}
+		sort.Strings(names)
+		return nil, c.errorf("%v: flag --%v is ambiguous (%v)", c.Name, name, strings.Join(names, ", "))
+	}
+	for _, opt := range candidates {
+		return opt, nil
+	}
+	return nil, nil
+}
+
+//Returns the visible long flag of the command, or its parents, closest to the given name
+func (c Command) suggestFlag(name string) string {
+	var names []string
+	for cmd := &c; cmd != nil; cmd = cmd.parent {
+		for _, flag := range visibleFlags(cmd.Flags()) {
+			if flag.Long != "" {
+				names = append(names, flag.Long)
+			}
+		}
+	}
+	return closestName(c.key(name), names, c.key)
+}
+
+//Returns the visible command closest to the given name
+func (p *Parser) suggestCommand(name string) string {
+	var names []string
+	for _, cmd := range visibleCommands(p.Commands) {
+		names = append(names, cmd.Name)
+	}
+	return closestName(p.key(name), names, p.key)
+}
+
+//Returns the candidate at the smallest edit distance from name, as long as it's not greater than 2.
+//Ties are resolved alphabetically
+func closestName(name string, candidates []string, key func(string) string) (closest string) {
+	sort.Strings(candidates)
+	best := 3
+	for _, candidate := range candidates {
+		if d := levenshtein(name, key(candidate)); d < best {
+			best = d
+			closest = candidate
+		}
+	}
+	return
+}
+
+//Computes the Levenshtein distance between a and b
+func levenshtein(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		curr := make([]int, len(t)+1)
+		curr[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+//looks for the flag in the command and then in its parents, so global flags are also accepted after
+//the command name. The flags of the command shadow the ones of its parents
+func (c Command) lookupFlag(key string, long bool) (*Flag, bool) {
+	for cmd := &c; cmd != nil; cmd = cmd.parent {
+		flags := cmd.innerFlagsShort
+		if long {
+			flags = cmd.innerFlagsLong
+		}
+		if opt, ok := flags[key]; ok {
+			return opt, true
+		}
+	}
+	return nil, false
+}
+
+//checks if the argument is a flag known by the command, either directly or as a cluster of short switches
+func (c Command) isFlag(arg string) bool {
+	if strings.HasPrefix(arg, "--") {
+		name := arg[2:]
+		if idx := strings.Index(name, "="); idx > 0 {
+			name = name[:idx]
+		}
+		opt, err := c.lookupLong(name)
+		return opt != nil || err != nil || c.lookupNegated(name) != nil
+	}
+	if !strings.HasPrefix(arg, "-") {
+		return false
+	}
+	if _, ok := c.lookupFlag(c.key(arg[1:]), false); ok {
+		return true
+	}
+	_, _, ok := c.clusterFlags(arg)
+	return ok
+}
+
+//builds the callable for a long flag with its value after =. Switches accept true or false, and
+//their functions receive it as the value
+func (c Command) inlineValue(opt *Flag, arg, value string, pos int) (callables []flagCallable, newPos int, err error) {
+	newPos = pos
+	switch {
+	case opt.Type == Switch:
+		b, perr := strconv.ParseBool(value)
+		if perr != nil {
+			return nil, pos, ValidationError{opt.name(), value, c, fmt.Errorf("expected true or false")}
+		}
+		value = strconv.FormatBool(b)
+	case opt.consumer != nil || opt.nargs != 1:
+		return nil, pos, c.errorf("%v takes several values, they can't be given after =", arg)
+	}
+	return []flagCallable{newFlagCallable(opt, value, false)}, pos, nil
+}
+
+//decides if the argument after an unknown flag is its value, so it's passed through with it. It is
+//unless it's a flag or a command, or the flag has its value after =
+func (p *Parser) passThroughValue(args []string, pos int, currentCommand Command) bool {
+	if strings.Contains(args[pos], "=") || pos+1 >= len(args) {
+		return false
+	}
+	next := args[pos+1]
+	if _, isFlagArg := currentCommand.flagForm(next); isFlagArg {
+		return false
+	}
+	_, isCommand, _ := p.lookupCommand(next, currentCommand)
+	return !isCommand && !p.isHelp(next)
+}
+
+//parses a cluster of short flags (-vxf, -ofoo or -vofoo). An option ending the cluster without
+//value (-vo foo) takes the next argument
+func (c Command) parseCluster(args []string, pos int, flags []*Flag, value string, run *parsing) (callables []flagCallable, newPos int, err error) {
+	newPos = pos
+	for _, opt := range flags {
+		c.warnDeprecated(*opt, "-"+opt.Short, run)
+		if opt.Type == Switch {
+			callables = append(callables, newFlagCallable(opt, "", true))
+			continue
+		}
+		if value == "" && opt.hasOptional {
+			value = opt.optionalValue
+		} else if value == "" {
+			if pos+1 >= len(args) || c.isTypedFlag(args[pos+1]) {
+				return nil, pos, MissingValueError{"-" + opt.Short, c, pos}
+			}
+			value = args[pos+1]
+			newPos = pos + 1
+		}
+		callables = append(callables, newFlagCallable(opt, value, true))
 	}
-	callable = flagCallable{fn, *opt}
 	return
 }
 
+//returns the flags of the cluster, if every character is a switch but the last flag, which can be
+//an option followed by its value
+func (c Command) clusterFlags(arg string) (flags []*Flag, value string, ok bool) {
+	if len(arg) < 3 {
+		return nil, "", false
+	}
+	shorts := arg[1:]
+	for i, short := range shorts {
+		opt, exists := c.lookupFlag(c.key(string(short)), false)
+		if !exists {
+			return nil, "", false
+		}
+		flags = append(flags, opt)
+		if opt.Type == Option {
+			//options taking several arguments need them apart
+			if opt.nargs != 1 || opt.consumer != nil {
+				return nil, "", false
+			}
+			return flags, shorts[i+utf8.RuneLen(short):], true
+		}
+	}
+	return flags, "", true
+}
+
+//splits the list option value, leaving out the empty elements
+func splitList(value, separator string) []string {
+	var elements []string
+	for _, element := range strings.Split(value, separator) {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+//writes the deprecation message of the flag, if any, to the error output. Nothing is written when
+//just checking the arguments, the flag is warned about when parsed for real
+func (c Command) warnDeprecated(flag Flag, name string, run *parsing) {
+	if flag.deprecation != "" && !run.dryRun {
+		fmt.Fprintf(c.errorWriter(), "%v is deprecated: %v\n", name, flag.deprecation)
+	}
+}
+
+//merges the occurrences of every count switch or list option into a single callable, placed at its
+//first occurrence, receiving the number of times the switch was found or all the list elements
+func collapseRepeated(flagsToCall []flagCallable) []flagCallable {
+	var collapsed []flagCallable
+	counts := make(map[string]int)
+	lists := make(map[string][]string)
+	for _, fc := range flagsToCall {
+		if fc.flag.list != nil {
+			if _, found := lists[fc.flag.name()]; !found {
+				flag := fc.flag
+				collapsed = append(collapsed, flagCallable{func(context.Context) error {
+					return flag.list(flag.name(), lists[flag.name()])
+				}, flag, ""})
+			}
+			lists[fc.flag.name()] = append(lists[fc.flag.name()], splitList(fc.value, fc.flag.separator)...)
+			continue
+		}
+		if fc.flag.counter == nil {
+			collapsed = append(collapsed, fc)
+			continue
+		}
+		if counts[fc.flag.name()] == 0 {
+			flag := fc.flag
+			collapsed = append(collapsed, flagCallable{func(context.Context) error {
+				return flag.counter(flag.name(), counts[flag.name()])
+			}, flag, ""})
+		}
+		counts[fc.flag.name()]++
+	}
+	return collapsed
+}
+
 //checks if the mandatory flags were visited
 func checkVisited(visited []flagCallable, command Command) error {
+	if missing := missingMandatory(visited, command); len(missing) > 0 {
+		return missing[0]
+	}
+	return nil
+}
+
+//returns an error for every mandatory flag not visited
+func missingMandatory(visited []flagCallable, command Command) (errs []error) {
 	for _, flag := range command.Flags() {
 		if flag.Mandatory {
-			ok := false
-			for _, vFlag := range visited {
-				if vFlag.flag.Long == flag.Long {
-					ok = true
-					break
-				}
+			if !isVisited(visited, flag) {
+				errs = append(errs, MissingMandatoryError{flag.name(), command})
 			}
-			if !ok {
-				return command.errorf("option/switch --%v is mandatory for command %v", flag.Long, command.Name)
+		}
+	}
+	return
+}
+
+//checks if the flag is among the visited ones
+func isVisited(visited []flagCallable, flag Flag) bool {
+	for _, vFlag := range visited {
+		if vFlag.flag.Long == flag.Long && vFlag.flag.Short == flag.Short {
+			return true
+		}
+	}
+	return false
+}
+
+//builds the flag callables for the non visited flags taking the value from, in this order, the
+//environment, the defaults loaded with Parser.LoadDefaults or the flag default. Switches are
+//activated by truthy values, bool flags get true or false
+func fallbackFlags(visited []flagCallable, command Command, defaults map[string]map[string]string) (callables []flagCallable) {
+	for _, flag := range command.orderedFlags {
+		if isVisited(visited, *flag) {
+			continue
+		}
+		var value string
+		ok := false
+		if flag.env != "" {
+			value, ok = os.LookupEnv(flag.env)
+		}
+		if !ok && flag.Long != "" {
+			value, ok = defaults[defaultsKey(command)][command.key(flag.Long)]
+		}
+		if !ok {
+			value, ok = flag.defaultValue, flag.hasDefault
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case flag.negatable: //switched off by falsy values
+			value = strconv.FormatBool(isTruthy(value))
+		case flag.Type == Switch:
+			if !isTruthy(value) {
+				continue
 			}
+			value = ""
 		}
+		callables = append(callables, newFlagCallable(flag, value, false))
 	}
-	return nil
+	return
 }
 
 //convinience for creating parsing errors
@@ -3,12 +3,26 @@
 package subcommand
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //Convinience type for funcions passed to commands
 type CommandFunction func(string, ...string) error
 
+//Command function receiving the context passed to Parser.ParseContext
+type CommandFunctionCtx func(ctx context.Context, name string, args ...string) error
+
+//CommandHandler is implemented by types handling a command, Run receives the same arguments as a
+//CommandFunction
+type CommandHandler interface {
+	Run(name string, args ...string) error
+}
+
 //Command aggregates different flags under a common name. Every time a command is found during the parsing process the associated function is executed.
 type Command struct {
 	//Name
@@ -19,9 +33,22 @@ type Command struct {
 	innerFlagsShort map[string]*Flag
 	orderedFlags    []*Flag //so we keep the order of the flags
 	fn              CommandFunction
+	ctxFn           CommandFunctionCtx //used instead of fn when set
+	preFlagsFn      func() error
 	postFlagsFn     func() error
 	parent          *Command
 	arity           Arity
+	hidden          bool //not shown in the help
+	multiCharShorts bool //allows short definitions longer than one character, only used by the root command
+	caseInsensitive bool //flags and commands are matched ignoring case, only used by the root command
+	usage           string //usage line shown in the help instead of the generic one
+	defaultCommand  string //command executed when none is found, only used by the root command
+	errorFn         func(error) error //transforms the errors found parsing the command
+	flagPrefixes    bool //long flags are matched by unambiguous prefixes, only used by the root command
+	examples        string //shown at the end of the help
+	longPrefix      string //prefix of the long flags, -- when empty, only used by the root command
+	shortPrefix     string //prefix of the short flags, - when empty, only used by the root command
+	errOut          io.Writer //writer where the parsing warnings are written to, only used by the root command
 }
 
 //Access to flags
@@ -29,7 +56,8 @@ type Flagged interface {
 	Flags() []Flag
 }
 
-//getFlags returns a slice containing the c's flags
+//getFlags returns a slice containing the c's flags in the order they were added.
+//The help shows them sorted by long name
 func (c *Command) Flags() []Flag {
 	//return c.Name
 	flags := make([]Flag, 0)
@@ -39,6 +67,40 @@ func (c *Command) Flags() []Flag {
 	return flags
 }
 
+//AllFlags returns the flags of c followed by the ones of its ancestors up to the parser. The flags
+//of a command shadow the ones of its ancestors with the same long or short definition
+func (c *Command) AllFlags() []Flag {
+	flags := make([]Flag, 0)
+	for cmd := c; cmd != nil; cmd = cmd.parent {
+		for _, flag := range cmd.orderedFlags {
+			if !shadowed(*flag, flags) {
+				flags = append(flags, *flag)
+			}
+		}
+	}
+	return flags
+}
+
+//checks if the flag was added to the command
+func (c *Command) owns(flag *Flag) bool {
+	for _, f := range c.orderedFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+//checks if one of the flags has the same long or short definition as flag
+func shadowed(flag Flag, flags []Flag) bool {
+	for _, f := range flags {
+		if (flag.Long != "" && f.Long == flag.Long) || (flag.Short != "" && f.Short == flag.Short) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Command) MandatoryFlags() []Flag {
 	flags := make([]Flag, 0)
 	for _, val := range c.orderedFlags {
@@ -59,11 +121,83 @@ func (c *Command) NonMandatoryFlags() []Flag {
 	return flags
 }
 
+//Hidden hides the command from the help. Hidden commands are parsed as any other command
+func (c *Command) Hidden(isIt bool) *Command {
+	c.hidden = isIt
+	return c
+}
+
+//SetDefault makes the command the one executed when no command is found in the arguments (see
+//Parser.SetDefaultCommand)
+func (c *Command) SetDefault() *Command {
+	c.root().defaultCommand = c.Name
+	return c
+}
+
+//IsHidden returns true if the command is hidden from the help
+func (c Command) IsHidden() bool {
+	return c.hidden
+}
+
+//OnError sets a function receiving the errors found parsing the command flags or executing the
+//command, before they are returned by Parse. It can replace the error to give a tailored hint, or
+//return nil to ignore it
+func (c *Command) OnError(fn func(err error) error) *Command {
+	c.errorFn = fn
+	return c
+}
+
+//Examples sets the usage examples shown at the end of the command help
+func (c *Command) Examples(text string) *Command {
+	c.examples = text
+	return c
+}
+
+//Usage sets the usage line shown in the help instead of the generic one. The usage is a template
+//executed with the command as data, "{{.Name}} [OPTIONS] FILE" for instance. For the parser it
+//replaces the program synopsis
+func (c *Command) Usage(usage string) *Command {
+	c.usage = usage
+	return c
+}
+
+//PreFlags sets a function executed once the command flags have been checked and before calling any
+//flag function. This can be used to set up the state the flag functions depend on. An error aborts
+//the parsing process before calling the flag functions
+func (c *Command) PreFlags(fn func() error) *Command {
+	c.preFlagsFn = fn
+	return c
+}
+
+//PostFlags sets a function executed once the command flags have been consumed, before the command
+//function. This can be used to dinamically adjust the command depending on the flags' state
+func (c *Command) PostFlags(fn func() error) *Command {
+	c.postFlagsFn = fn
+	return c
+}
+
 //Returns the command parent
 func (c Command) Parent() *Command {
 	return c.parent
 }
 
+//Returns the root of the command tree, the parser's command
+func (c *Command) root() *Command {
+	root := c
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
+//Returns the key used to register and look up flags and commands
+func (c *Command) key(name string) string {
+	if c.root().caseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
 func newCommand(parent *Command, name string, shortDesc string, longDesc string, fn CommandFunction) *Command {
 	if longDesc == "" {
 		longDesc = shortDesc
@@ -73,17 +207,19 @@ func newCommand(parent *Command, name string, shortDesc string, longDesc string,
 		innerFlagsShort: make(map[string]*Flag),
 		innerFlagsLong:  make(map[string]*Flag),
 		fn:              fn,
+		preFlagsFn:      func() error { return nil },
 		postFlagsFn:     func() error { return nil },
 		ShortDesc :      shortDesc,
 		LongDesc :       longDesc,
 		parent:          parent,
-		arity:           Arity{-1, "arg1 arg2 ..."},
+		arity:           newArity(-1, "arg1 arg2 ..."),
 	}
 }
 
 //Adds a new option to the command to be used as "--option OPTION" (expects a value after the flag) in the command line
-//The short definition has no length restriction but it should be significantly shorter that its long counterpart, it can be an empty string.
-//The function fn receives the name of the option and its value
+//The short definition is a single character, it can be an empty string (see Parser.AllowMultiCharShorts).
+//The long definition can be empty as well for options used just as "-o OPTION", then the short one identifies the option.
+//The function fn receives the name of the option and its value, it can be nil when the value is read with Flag.Value
 //Example:
 //command.AddOption("path","p",setPath)//option
 //[...]
@@ -97,8 +233,10 @@ func (c *Command) AddOption(long, short, shortDesc, longDesc, values string, fn
 }
 
 //Adds a new switch to the command to be used as "--switch" (expects no value after the flag) in the command line
-//The short definition has no length restriction but it should be significantly shorter that its long counterpart, it can be an empty string.
-//The function fn receives two strings, the first is the switch name and the second is just an empty string
+//The short definition is a single character, it can be an empty string (see Parser.AllowMultiCharShorts).
+//The long definition can be empty as well for switches used just as "-s", then the short one identifies the switch.
+//The function fn receives two strings, the first is the switch name and the second is just an empty string,
+//it can be nil when the switch is checked with Flag.WasSet
 //Example:
 //command.AddSwitch("verbose","v",setVerbose)//option
 //[...]
@@ -111,16 +249,259 @@ func (c *Command) AddSwitch(long string, short string, shortDesc string, fn Flag
 	return flag
 }
 
+//TryAddOption works as AddOption but returns an error instead of panicking when the definitions are
+//already used by another flag, for commands built from data. Malformed definitions still panic
+func (c *Command) TryAddOption(long, short, shortDesc, longDesc, values string, fn FlagFunction) (*Flag, error) {
+	flag := buildFlag(long, short, shortDesc, longDesc, values, fn, Option)
+	if err := c.addFlagErr(flag); err != nil {
+		return nil, err
+	}
+	return flag, nil
+}
+
+//TryAddSwitch works as AddSwitch but returns an error instead of panicking when the definitions are
+//already used by another flag. Malformed definitions still panic
+func (c *Command) TryAddSwitch(long string, short string, shortDesc string, fn FlagFunction) (*Flag, error) {
+	flag := buildFlag(long, short, shortDesc, "", "", fn, Switch)
+	if err := c.addFlagErr(flag); err != nil {
+		return nil, err
+	}
+	return flag, nil
+}
+
+//AddOptionCtx works as AddOption for functions receiving the context passed to Parser.ParseContext
+func (c *Command) AddOptionCtx(long, short, shortDesc, longDesc, values string, fn FlagFunctionCtx) *Flag {
+	flag := c.AddOption(long, short, shortDesc, longDesc, values, func(string, string) error { return nil })
+	flag.ctxFn = fn
+	return flag
+}
+
+//AddOptionHandler works as AddOption calling the Set method of h
+func (c *Command) AddOptionHandler(long, short, shortDesc, longDesc, values string, h FlagHandler) *Flag {
+	return c.AddOption(long, short, shortDesc, longDesc, values, h.Set)
+}
+
+//AddSwitchHandler works as AddSwitch calling the Set method of h
+func (c *Command) AddSwitchHandler(long string, short string, shortDesc string, h FlagHandler) *Flag {
+	return c.AddSwitch(long, short, shortDesc, h.Set)
+}
+
+//AddSwitchCtx works as AddSwitch for functions receiving the context passed to Parser.ParseContext
+func (c *Command) AddSwitchCtx(long string, short string, shortDesc string, fn FlagFunctionCtx) *Flag {
+	flag := c.AddSwitch(long, short, shortDesc, func(string, string) error { return nil })
+	flag.ctxFn = fn
+	return flag
+}
+
+//Adds a new flag consuming a variable number of the arguments following it, such as
+//"-exec cmd {} ;". The function fn receives the remaining arguments while parsing, before calling
+//any flag function, and returns how many of them are consumed. The value of the flag is the
+//consumed arguments joined by a space. As it's called during the parsing, fn may be called twice
+//when collecting errors (see Parser.CollectErrors), and it is called by Parser.Plan too. It should
+//have no side effects
+//Example:
+//command.AddConsumerFlag("exec","","Command to execute",func(name string,args []string) (int,error){
+//      for i,arg:=range args{
+//              if arg==";"{
+//                      execArgs=args[:i]
+//                      return i+1,nil
+//              }
+//      }
+//      return 0,fmt.Errorf("%v not terminated by ;",name)
+//})
+func (c *Command) AddConsumerFlag(long, short, description string, fn FlagConsumer) *Flag {
+	flag := buildFlag(long, short, description, "", "ARGS...", nil, Option)
+	flag.consumer = fn
+	c.addFlag(flag)
+	return flag
+}
+
+//AddBoolFlag adds a switch turned on by --flag or --flag=true and off by --flag=false or --no-flag.
+//Other values after = are rejected. The function fn receives the flag name and its state, it's
+//called only when the flag is present in the arguments, the environment or the defaults. The long
+//definition can't be empty
+func (c *Command) AddBoolFlag(long, short, description string, fn func(name string, value bool) error) *Flag {
+	if strings.Trim(long, " ") == "" {
+		panic(fmt.Sprintf("Bool flag -%v needs a long definition", short))
+	}
+	flag := buildFlag(long, short, description, "", "", func(name, value string) error {
+		return fn(name, value == "" || isTruthy(value))
+	}, Switch)
+	flag.negatable = true
+	c.addFlag(flag)
+	return flag
+}
+
+//Adds a new count switch to the command. A count switch can be repeated, also in a cluster of short
+//switches (-vvv), and the function fn is called once after the parsing process with the switch
+//name and the number of times it was found
+//Example:
+//command.AddCountSwitch("verbose","v","Verbosity level",setVerbosity)
+//[...]
+// func setVerbosity(name string,count int) error{
+//      logLevel=count
+//      return nil
+//}
+func (c *Command) AddCountSwitch(long, short, description string, fn func(name string, count int) error) *Flag {
+	flag := buildFlag(long, short, description, "", "", func(string, string) error { return nil }, Switch)
+	flag.counter = fn
+	c.addFlag(flag)
+	return flag
+}
+
+//Adds a new option whose value is a floating point number, parsed with strconv.ParseFloat
+//The function fn receives the name of the option and its value
+func (c *Command) AddFloatOption(long, short, description string, fn func(name string, value float64) error) *Flag {
+	return c.addTypedOption(long, short, description, "a floating point number", func(value string) (interface{}, error) {
+		return strconv.ParseFloat(value, 64)
+	}, func(name string, value interface{}) error {
+		return fn(name, value.(float64))
+	})
+}
+
+//Adds a new option whose value is a boolean, parsed with strconv.ParseBool
+//The function fn receives the name of the option and its value
+func (c *Command) AddBoolOption(long, short, description string, fn func(name string, value bool) error) *Flag {
+	return c.addTypedOption(long, short, description, "a boolean", func(value string) (interface{}, error) {
+		return strconv.ParseBool(value)
+	}, func(name string, value interface{}) error {
+		return fn(name, value.(bool))
+	})
+}
+
+//Adds a new option whose value is a duration, parsed with time.ParseDuration (--timeout 30s)
+//The function fn receives the name of the option and its value
+func (c *Command) AddDurationOption(long, short, description string, fn func(name string, d time.Duration) error) *Flag {
+	return c.addTypedOption(long, short, description, "a duration", func(value string) (interface{}, error) {
+		return time.ParseDuration(value)
+	}, func(name string, value interface{}) error {
+		return fn(name, value.(time.Duration))
+	})
+}
+
+//Adds a new option whose value is a file name, the function fn receives the file opened for reading
+//or the standard input when the value is - (see Flag.AllowStdin). The file is closed after calling fn
+//Example:
+//command.AddReaderOption("input","i","Input file, - for stdin",func(name string,r io.Reader) error{
+//      data,err:=ioutil.ReadAll(r)
+//      [...]
+//})
+func (c *Command) AddReaderOption(long, short, description string, fn func(name string, r io.Reader) error) *Flag {
+	var flag *Flag
+	flag = c.AddOption(long, short, description, "", "", func(name, value string) error {
+		r, err := flag.Open(value)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return fn(name, r)
+	})
+	return flag.AllowStdin()
+}
+
+//Adds a new option whose value is a list split on the separator, comma if empty (--tags a,b,c).
+//The elements are trimmed and the empty ones left out. The option can be repeated and the function
+//fn is called once after the parsing process with the elements of every occurrence
+func (c *Command) AddListOption(long, short, description, separator string, fn func(name string, values []string) error) *Flag {
+	if separator == "" {
+		separator = ","
+	}
+	flag := buildFlag(long, short, description, "", "", nil, Option)
+	flag.list = fn
+	flag.separator = separator
+	c.addFlag(flag)
+	return flag
+}
+
+//Adds a new option whose value is a key=value pair, split on the first =. The option can be repeated
+//(-D name=test -D level=3) and the function fn is called for every pair with the option name, the key and the value
+func (c *Command) AddMapOption(long, short, description string, fn func(name, key, value string) error) *Flag {
+	return c.addTypedOption(long, short, description, "a key=value pair", func(value string) (interface{}, error) {
+		pair := strings.SplitN(value, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("no = found in %v", value)
+		}
+		return pair, nil
+	}, func(name string, value interface{}) error {
+		pair := value.([]string)
+		return fn(name, pair[0], pair[1])
+	})
+}
+
+//Adds an option whose value is converted before calling fn. The conversion is checked as a
+//validation so a wrong value is reported, naming what was expected, before calling any flag function
+func (c *Command) addTypedOption(long, short, description, expected string, convert func(string) (interface{}, error), fn func(string, interface{}) error) *Flag {
+	flag := c.AddOption(long, short, description, "", "", func(name, value string) error {
+		converted, err := convert(value)
+		if err != nil {
+			return err
+		}
+		return fn(name, converted)
+	})
+	return flag.Validate(func(value string) error {
+		if _, err := convert(value); err != nil {
+			return fmt.Errorf("expected %v", expected)
+		}
+		return nil
+	})
+}
+
+//Sorts the commands by name
+type byName []*Command
+
+func (c byName) Len() int           { return len(c) }
+func (c byName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+
+//Arity defines the number of arguments a command accepts
 type Arity struct {
+	//Exact number of arguments, -1 when any number within Min and Max is accepted
 	Count       int
 	Description string
+	//Minimum and maximum number of arguments, -1 as Max means no upper bound
+	Min int
+	Max int
+}
+
+//builds the arity for an exact number of arguments or, if -1, any number of them
+func newArity(count int, description string) Arity {
+	if count == -1 {
+		return Arity{Count: -1, Description: description, Min: 0, Max: -1}
+	}
+	return Arity{Count: count, Description: description, Min: count, Max: count}
+}
+
+//Checks if the given number of arguments is accepted
+func (a Arity) Accepts(args int) bool {
+	return args >= a.Min && (a.Max == -1 || args <= a.Max)
+}
+
+//Describes the accepted number of arguments
+func (a Arity) String() string {
+	switch {
+	case a.Count != -1:
+		return fmt.Sprintf("%v", a.Count)
+	case a.Max == -1:
+		return fmt.Sprintf("at least %v", a.Min)
+	}
+	return fmt.Sprintf("between %v and %v", a.Min, a.Max)
 }
 
 //Set arity:
 //-1 accepts infinite arguments.
 //Other restricts the arity to the given num
 func (c *Command) SetArity(arity int, description string) *Command {
-	c.arity = Arity{arity, description}
+	c.arity = newArity(arity, description)
+	return c
+}
+
+//SetArityRange restricts the number of arguments to be between min and max, both included.
+//-1 as max means no upper bound, SetArityRange(1, -1, "file ...") for at least one argument
+func (c *Command) SetArityRange(min, max int, description string) *Command {
+	if min < 0 || (max != -1 && max < min) {
+		panic(fmt.Sprintf("Invalid arity range [%v, %v]", min, max))
+	}
+	c.arity = Arity{Count: -1, Description: description, Min: min, Max: max}
 	return c
 }
 
@@ -128,19 +509,50 @@ func (c Command) Arity() Arity {
 	return c.arity
 }
 
+//NoArgs makes the command reject any argument. Commands accept any number of them by default, while
+//the parser accepts none unless OnCommand is set
+func (c *Command) NoArgs() *Command {
+	return c.SetArity(0, "")
+}
+
+//ExactArgs restricts the number of arguments to n, keeping the description shown in the help
+func (c *Command) ExactArgs(n int) *Command {
+	return c.SetArity(n, c.arity.Description)
+}
+
+//MinArgs makes the command require at least n arguments, keeping the description shown in the help
+func (c *Command) MinArgs(n int) *Command {
+	return c.SetArityRange(n, -1, c.arity.Description)
+}
+
 //Adds a flag to the command
 func (c *Command) addFlag(flag *Flag) {
+	if err := c.addFlagErr(flag); err != nil {
+		panic(err)
+	}
+}
 
-	if _, exists := c.innerFlagsLong[flag.Long]; exists {
-		panic(fmt.Errorf("Flag '%s' already exists ", flag.Long))
+//adds the flag to the command unless its short definition is too long or its definitions are
+//already used by another flag
+func (c *Command) addFlagErr(flag *Flag) error {
+	if !c.root().multiCharShorts && !checkShort(flag.Short) {
+		return fmt.Errorf("Short definition %v has more than one character. Only one is accepted", flag.Short)
 	}
-	if _, exists := c.innerFlagsShort[flag.Short]; exists {
-		panic(fmt.Errorf("Flag '%s' already exists ", flag.Short))
+
+	if existing, exists := c.innerFlagsLong[c.key(flag.Long)]; exists && flag.Long != "" {
+		return fmt.Errorf("Long definition --%s of flag %s already used by flag %s in command %s",
+			flag.Long, flag.name(), existing.name(), c.Name)
+	}
+	if existing, exists := c.innerFlagsShort[c.key(flag.Short)]; exists && flag.Short != "" {
+		return fmt.Errorf("Short definition -%s of flag %s already used by flag %s in command %s",
+			flag.Short, flag.name(), existing.name(), c.Name)
+	}
+	if flag.Long != "" {
+		c.innerFlagsLong[c.key(flag.Long)] = flag
 	}
-	c.innerFlagsLong[flag.Long] = flag
 	c.orderedFlags = append(c.orderedFlags, flag)
 	if flag.Short != "" {
-		c.innerFlagsShort[flag.Short] = flag
+		c.innerFlagsShort[c.key(flag.Short)] = flag
 	}
-
+	return nil
 }
@@ -1,9 +1,17 @@
 package subcommand
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 var emptyFn = func(name, value string) error { return nil }
@@ -73,13 +81,56 @@ func TestBuildFlagInvalidShort(t *testing.T) {
 	buildFlag("option", "o o", "", "", "", emptyFn, Option)
 }
 
+func TestBuildFlagDashes(t *testing.T) {
+	for _, def := range [][]string{{"-path", "p"}, {"path", "-p"}, {"--path", ""}} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Definitions %q accepted", def)
+				}
+			}()
+			buildFlag(def[0], def[1], "", "", "", emptyFn, Option)
+		}()
+	}
+}
+
 func TestEmptyLong(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
-			t.Error("Not panicked with empty long definition")
+			t.Error("Not panicked with empty long and short definitions")
 		}
 	}()
-	buildFlag("", "o", "", "", "", emptyFn, Option)
+	buildFlag("", "", "", "", "", emptyFn, Option)
+}
+
+func TestShortOnly(t *testing.T) {
+	var names, values []string
+	fn := func(name, value string) error {
+		names = append(names, name)
+		values = append(values, value)
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddOption("", "o", "", "", "", fn)
+	parser.AddSwitch("", "x", "", fn)
+	parser.AddSwitch("other", "", "", fn)
+	if _, err := parser.Parse([]string{"-o", "val", "-x"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(names, ",") != "o,x" || values[0] != "val" {
+		t.Errorf("Wrong calls %v %v", names, values)
+	}
+	if _, err := parser.Parse([]string{"--"}); err == nil {
+		t.Error("Empty long flag accepted")
+	}
+	parser.AddOption("", "m", "", "", "", fn).Must(true)
+	_, err := parser.Parse([]string{"-x"})
+	if e, ok := err.(MissingMandatoryError); !ok || e.Flag != "m" || !strings.Contains(e.Error(), " -m ") {
+		t.Errorf("Expected MissingMandatoryError for -m got %v", err)
+	}
+	if prefix := parser.Flags()[0].FlagStringPrefix(); prefix != "-o O" {
+		t.Errorf("Wrong help prefix %q", prefix)
+	}
 }
 
 func TestAddCommand(t *testing.T) {
@@ -261,14 +312,15 @@ func TestParseInnerFlagCommand(t *testing.T) {
 }
 
 func TestParseMandatorySwitch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with a mandatory switch")
+		}
+	}()
 	parser := NewParser("test")
 	parser.AddSwitch("switch", "s", "This is a mandatory switch", func(string, string) error {
 		return nil
 	}).Must(true)
-	_, err := parser.Parse([]string{""})
-	if err == nil {
-		t.Error("Mandatory switch didn't complain")
-	}
 }
 
 func TestParseMandatoryOption(t *testing.T) {
@@ -294,14 +346,15 @@ func TestParseMandatoryInnerOption(t *testing.T) {
 }
 
 func TestParseMandatoryInnerSwitch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with a mandatory switch")
+		}
+	}()
 	parser := NewParser("test")
-	parser.AddSwitch("switch", "s", "This is a mandatory switch", func(string, string) error {
+	parser.AddCommand("command", "", "", emptyFnMult).AddSwitch("switch", "s", "This is a mandatory switch", func(string, string) error {
 		return nil
 	}).Must(true)
-	_, err := parser.Parse([]string{"command"})
-	if err == nil {
-		t.Error("Mandatory switch didn't complain")
-	}
 }
 func TestParseCommandWithLefts(t *testing.T) {
 	parser := NewParser("test")
@@ -435,6 +488,149 @@ func TestOnCommand(t *testing.T) {
 
 }
 
+func TestOnCommandLeftovers(t *testing.T) {
+	var calls []string
+	parser := NewParser("test")
+	parser.AddSwitch("switch", "s", "", func(name, value string) error {
+		calls = append(calls, name)
+		return nil
+	})
+	parser.OnCommand(func(name string, args ...string) error {
+		calls = append(calls, fmt.Sprintf("%v%v", name, args))
+		return nil
+	})
+	parser.AddCommand("command", "", "", func(name string, args ...string) error {
+		calls = append(calls, fmt.Sprintf("%v%v", name, args))
+		return nil
+	})
+	leftOvers, err := parser.Parse([]string{"-s", "left1", "left2", "command"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(calls) != "[switch test[left1 left2] command[]]" || fmt.Sprint(leftOvers) != "[left1 left2]" {
+		t.Errorf("Wrong calls %v, left overs %v", calls, leftOvers)
+	}
+	calls = nil
+	if _, err = parser.Parse([]string{"left1", "-s", "command"}); err == nil {
+		t.Errorf("Flag after the left overs accepted")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Functions called %v", calls)
+	}
+}
+
+func TestOnCommandArity(t *testing.T) {
+	buf := new(bytes.Buffer)
+	parser := NewParser("test")
+	parser.SetOutput(buf)
+	parser.SetArity(1, "FILE")
+	parser.OnCommand(emptyFnMult)
+	if _, err := parser.Parse([]string{"a", "b"}); err == nil {
+		t.Errorf("The arity set before OnCommand was lost")
+	}
+	parser.Parse([]string{"--help"})
+	if res := buf.String(); !strings.Contains(res, "Usage test [GLOBAL_OPTIONS] FILE command") {
+		t.Errorf("Wrong usage:\n%v", res)
+	}
+
+	buf.Reset()
+	parser = NewParser("test")
+	parser.SetOutput(buf)
+	parser.OnCommand(emptyFnMult)
+	if _, err := parser.Parse([]string{"a", "b"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser.Parse([]string{"help"})
+	if res := buf.String(); !strings.Contains(res, "Usage test [GLOBAL_OPTIONS] command") {
+		t.Errorf("Wrong usage:\n%v", res)
+	}
+}
+
+func TestNumericShorts(t *testing.T) {
+	one := false
+	var args []string
+	parser := NewParser("test")
+	cmd := parser.AddCommand("sort", "", "", func(name string, values ...string) error {
+		args = values
+		return nil
+	})
+	cmd.SetArity(-1, "")
+	cmd.AddSwitch("", "1", "", func(string, string) error {
+		one = true
+		return nil
+	})
+	if _, err := parser.Parse([]string{"sort", "-1", "-2"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !one {
+		t.Error("Switch -1 not called")
+	}
+	if fmt.Sprint(args) != "[-2]" {
+		t.Errorf("Wrong arguments %v", args)
+	}
+	//-2 is not registered, so it stays a number
+	args = nil
+	if _, err := parser.Parse([]string{"sort", "-2"}); err != nil || fmt.Sprint(args) != "[-2]" {
+		t.Errorf("Wrong arguments %v (%v)", args, err)
+	}
+}
+
+func TestAllowUnknownFlags(t *testing.T) {
+	verbose := false
+	var args []string
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", func(string, string) error {
+		verbose = true
+		return nil
+	})
+	parser.AddCommand("run", "", "", func(name string, values ...string) error {
+		args = values
+		return nil
+	}).SetArity(-1, "")
+	if _, err := parser.Parse([]string{"run", "--color", "always", "-x", "--depth=2", "file"}); err == nil {
+		t.Errorf("Unknown flags accepted")
+	}
+	parser.AllowUnknownFlags(true)
+	if _, err := parser.Parse([]string{"-v", "run", "--color", "always", "-x", "--depth=2", "file"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !verbose {
+		t.Error("Known flag not called")
+	}
+	if fmt.Sprint(args) != "[--color always -x --depth=2 file]" {
+		t.Errorf("Wrong arguments %v", args)
+	}
+	//the flags passed through don't count for the arity of the parser
+	leftOvers, err := parser.Parse([]string{"--unknown", "value", "run", "x"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(leftOvers) != "[--unknown value]" || fmt.Sprint(args) != "[x]" {
+		t.Errorf("Wrong leftovers %v and arguments %v", leftOvers, args)
+	}
+	if _, err := parser.Parse([]string{"--unknown", "value", "stray"}); err == nil {
+		t.Errorf("Leftover accepted by the parser")
+	}
+}
+
+func TestReset(t *testing.T) {
+	parser := NewParser("test")
+	flag := parser.AddOption("output", "o", "", "", "", emptyFn)
+	parser.AddCommand("run", "", "", emptyFnMult)
+	for i := 0; i < 2; i++ {
+		if _, err := parser.Parse([]string{"-o", "out", "run"}); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if !flag.WasSet() || flag.Value() != "out" || len(parser.VisitedFlags()) != 1 || len(parser.ExecutedCommands()) != 2 {
+			t.Errorf("Wrong results after parsing")
+		}
+		parser.Reset()
+		if flag.WasSet() || flag.Value() != "" || flag.Count() != 0 || len(parser.VisitedFlags()) != 0 || len(parser.ExecutedCommands()) != 0 {
+			t.Errorf("Results not cleared")
+		}
+	}
+}
+
 func TestPostFlags(t *testing.T) {
 	parser := NewParser("test")
 	visited := false
@@ -521,6 +717,89 @@ func TestArityCommandOther(t *testing.T) {
 	}
 }
 
+func TestArityBeforeFunctions(t *testing.T) {
+	var calls []string
+	parser := NewParser("test")
+	cmd := parser.AddCommand("command", "", "", func(name string, args ...string) error {
+		calls = append(calls, name)
+		return nil
+	}).SetArity(2, "arg1 arg2")
+	cmd.AddSwitch("switch", "s", "", func(name, value string) error {
+		calls = append(calls, name)
+		return nil
+	})
+	if _, err := parser.Parse([]string{"command", "-s", "arg1", "arg2", "arg3"}); err == nil {
+		t.Errorf("Wrong arity didn't complain")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Wrong calls %v", calls)
+	}
+	//no leftovers, nothing is called
+	calls = nil
+	if _, err := parser.Parse([]string{"command", "-s"}); err == nil {
+		t.Errorf("Wrong arity didn't complain")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Wrong calls %v", calls)
+	}
+}
+
+func TestArityDefaults(t *testing.T) {
+	parser := NewParser("test")
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	if _, err := parser.Parse([]string{"command", "a", "b", "c"}); err != nil {
+		t.Errorf("Command default arity not any %v", err)
+	}
+	if _, err := parser.Parse([]string{"a"}); err == nil {
+		t.Errorf("Parser default arity not zero")
+	}
+	for _, c := range []struct {
+		set      func()
+		accepted []int
+		rejected []int
+	}{
+		{func() { cmd.NoArgs() }, []int{0}, []int{1, 2}},
+		{func() { cmd.ExactArgs(2) }, []int{2}, []int{0, 1, 3}},
+		{func() { cmd.MinArgs(1) }, []int{1, 2, 10}, []int{0}},
+	} {
+		c.set()
+		for _, n := range c.accepted {
+			if !cmd.Arity().Accepts(n) {
+				t.Errorf("Arity %v rejects %v", cmd.Arity(), n)
+			}
+		}
+		for _, n := range c.rejected {
+			if cmd.Arity().Accepts(n) {
+				t.Errorf("Arity %v accepts %v", cmd.Arity(), n)
+			}
+		}
+	}
+	other := parser.AddCommand("other", "", "", emptyFnMult).MinArgs(1)
+	if other.Arity().Description != "arg1 arg2 ..." {
+		t.Errorf("Description not kept %q", other.Arity().Description)
+	}
+}
+
+func TestArityParserExact(t *testing.T) {
+	var files []string
+	parser := NewParser("test")
+	parser.OnCommand(func(name string, args ...string) error {
+		files = args
+		return nil
+	})
+	parser.SetArity(1, "FILE")
+	parser.AddCommand("command", "", "", emptyFnMult)
+	if _, err := parser.Parse([]string{"file.txt"}); err != nil || len(files) != 1 || files[0] != "file.txt" {
+		t.Errorf("Wrong arguments %v (%v)", files, err)
+	}
+	for _, args := range [][]string{{}, {"a", "b"}, {"command"}} {
+		_, err := parser.Parse(args)
+		if e, ok := err.(ArityError); !ok || e.Command.Name != "test" || len(e.Values) != 0 && len(e.Values) != 2 {
+			t.Errorf("Expected ArityError for %v got %v", args, err)
+		}
+	}
+}
+
 func TestArityParserErr(t *testing.T) {
 	parser := NewParser("test")
 	parser.AddCommand("command", "", "", func(string, ...string) error {
@@ -551,7 +830,60 @@ func TestUnknownCommand(t *testing.T) {
 	//multiple args arity by default
 	_, err := parser.Parse([]string{"parserArg"})
 	if err == nil {
-		t.Errorf("Unknown command didnt error", err)
+		t.Error("Unknown command didnt error")
+	}
+}
+
+func TestStrictCommands(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddCommand("com", "", "", emptyFnMult)
+	parser.SetArity(-1, "")
+	if _, err := parser.Parse([]string{"unknown"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	parser.StrictCommands(true)
+	_, err := parser.Parse([]string{"unknown"})
+	if uerr, ok := err.(UnknownCommandError); !ok || uerr.Value != "unknown" {
+		t.Errorf("Expected an UnknownCommandError, got %v", err)
+	}
+	if _, err := parser.Parse([]string{"com", "unknown"}); err != nil {
+		t.Errorf("Command parameters should be accepted %v", err)
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	parser := NewParser("test")
+	parser.StrictCommands(true)
+	parser.AddCommand("commit", "", "", emptyFnMult).AddSwitch("verbose", "v", "", emptyFn)
+	parser.AddCommand("secret", "", "", emptyFnMult).Hidden(true)
+	_, err := parser.Parse([]string{"comit"})
+	if e, ok := err.(UnknownCommandError); !ok || e.Suggestion != "commit" {
+		t.Errorf("Expected a suggestion got %#v", err)
+	} else if !strings.HasSuffix(err.Error(), "did you mean commit?") {
+		t.Errorf("Wrong error message %v", err)
+	}
+	_, err = parser.Parse([]string{"commit", "--verbos"})
+	if e, ok := err.(UnknownFlagError); !ok || e.Suggestion != "--verbose" {
+		t.Errorf("Expected a suggestion got %#v", err)
+	} else if !strings.HasSuffix(err.Error(), "did you mean --verbose?") {
+		t.Errorf("Wrong error message %v", err)
+	}
+	if _, err = parser.Parse([]string{"secre"}); err.(UnknownCommandError).Suggestion != "" {
+		t.Errorf("Hidden commands should not be suggested %v", err)
+	}
+	if _, err = parser.Parse([]string{"commit", "--something"}); err.(UnknownFlagError).Suggestion != "" {
+		t.Errorf("Unexpected suggestion %v", err)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		d    int
+	}{{"", "", 0}, {"abc", "", 3}, {"kitten", "sitting", 3}, {"verbos", "verbose", 1}, {"çà", "ca", 2}} {
+		if d := levenshtein(c.a, c.b); d != c.d {
+			t.Errorf("Distance between %q and %q is %v, got %v", c.a, c.b, c.d, d)
+		}
 	}
 }
 
@@ -578,14 +910,14 @@ func TestArityCheck(t *testing.T) {
 	lefts := []string{"cosa"}
 	c := Command{Name: "cmd"}
 	c.SetArity(0, "")
-	err := c.exec(lefts, *parser)
+	err := c.exec(lefts, parser)
 	if err == nil {
 		t.Error("Expected error not returned")
 	}
 	if !strings.Contains(err.Error(), "Arity") {
 		t.Error("Arity error not controled")
 	}
-	err = parser.exec(lefts, *parser)
+	err = parser.exec(lefts, parser)
 	if strings.Contains(err.Error(), "Arity") {
 		t.Error("Parser shouldn't complain about arity")
 	}
@@ -606,3 +938,1933 @@ func TestArityCheck(t *testing.T) {
 ////hPrinter.VisitParser(*parser)
 //parser.Parse([]string{"help","command"})
 /*}*/
+
+func TestAbbreviatedCommand(t *testing.T) {
+	parser := NewParser("test")
+	parser.AllowAbbreviations(true)
+	var name string
+	parser.AddCommand("status", "", "", func(command string, args ...string) error {
+		name = command
+		return nil
+	})
+	parser.AddCommand("commit", "", "", emptyFnMult)
+	_, err := parser.Parse([]string{"stat"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if name != "status" {
+		t.Errorf("Abbreviated command wasn't executed, got %v", name)
+	}
+}
+
+func TestAbbreviatedCommandExactWins(t *testing.T) {
+	parser := NewParser("test")
+	parser.AllowAbbreviations(true)
+	var name string
+	fn := func(command string, args ...string) error {
+		name = command
+		return nil
+	}
+	parser.AddCommand("st", "", "", fn)
+	parser.AddCommand("status", "", "", fn)
+	_, err := parser.Parse([]string{"st"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if name != "st" {
+		t.Errorf("Exact match didn't win, got %v", name)
+	}
+}
+
+func TestAbbreviatedCommandAmbiguous(t *testing.T) {
+	parser := NewParser("test")
+	parser.AllowAbbreviations(true)
+	parser.AddCommand("status", "", "", emptyFnMult)
+	parser.AddCommand("stash", "", "", emptyFnMult)
+	_, err := parser.Parse([]string{"sta"})
+	if err == nil {
+		t.Fatal("Ambiguous prefix didn't complain")
+	}
+	if !strings.Contains(err.Error(), "stash, status") {
+		t.Errorf("Candidates not listed in error: %v", err)
+	}
+}
+
+func TestAbbreviatedCommandDisabled(t *testing.T) {
+	parser := NewParser("test")
+	proc := false
+	parser.AddCommand("status", "", "", func(string, ...string) error {
+		proc = true
+		return nil
+	})
+	parser.Parse([]string{"stat"})
+	if proc {
+		t.Error("Abbreviation resolved without being allowed")
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddOption("option", "o", "", "", "", emptyFn)
+	cmd := parser.AddCommand("command", "", "", emptyFnMult).SetArity(0, "")
+	cmd.AddOption("mandatory", "m", "", "", "", emptyFn).Must(true)
+
+	_, err := parser.Parse([]string{"--nanana"})
+	if e, ok := err.(UnknownFlagError); !ok || e.Flag != "--nanana" {
+		t.Errorf("Expected UnknownFlagError got %#v", err)
+	}
+	_, err = parser.Parse([]string{"-o"})
+	if e, ok := err.(MissingValueError); !ok || e.Flag != "-o" {
+		t.Errorf("Expected MissingValueError got %#v", err)
+	}
+	_, err = parser.Parse([]string{"command"})
+	if e, ok := err.(MissingMandatoryError); !ok || e.Flag != "mandatory" || e.Command.Name != "command" {
+		t.Errorf("Expected MissingMandatoryError got %#v", err)
+	}
+	_, err = parser.Parse([]string{"command", "-m", "val", "arg"})
+	if e, ok := err.(ArityError); !ok || len(e.Values) != 1 {
+		t.Errorf("Expected ArityError got %#v", err)
+	}
+	_, err = parser.Parse([]string{"parserArg"})
+	if e, ok := err.(UnknownCommandError); !ok || e.Value != "parserArg" {
+		t.Errorf("Expected UnknownCommandError got %#v", err)
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddCommand("command", "", "", emptyFnMult)
+	if leftOvers := parser.MustParse([]string{"command", "arg"}); len(leftOvers) != 0 {
+		t.Errorf("The command leftovers returned %v", leftOvers)
+	}
+	parser.SetArity(-1, "")
+	if leftOvers := parser.MustParse([]string{"one", "two"}); fmt.Sprint(leftOvers) != "[one two]" {
+		t.Errorf("Wrong leftovers %v", leftOvers)
+	}
+	parser.SetArity(0, "")
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with unknown flag")
+		}
+	}()
+	parser.MustParse([]string{"--nanana"})
+}
+
+func TestParseCommandLine(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"test", "command", "arg1"}
+
+	parser := NewParser("test")
+	var lefts []string
+	parser.AddCommand("command", "", "", func(command string, args ...string) error {
+		lefts = args
+		return nil
+	})
+	_, err := parser.ParseCommandLine()
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(lefts) != 1 || lefts[0] != "arg1" {
+		t.Errorf("Program name not skipped %v", lefts)
+	}
+}
+
+func TestEnvOption(t *testing.T) {
+	os.Setenv("SUBCOMMAND_TEST_OPTION", "env")
+	defer os.Unsetenv("SUBCOMMAND_TEST_OPTION")
+	parser := NewParser("test")
+	var value string
+	parser.AddOption("option", "o", "", "", "", func(name, val string) error {
+		value = val
+		return nil
+	}).Env("SUBCOMMAND_TEST_OPTION").Must(true)
+
+	_, err := parser.Parse([]string{})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if value != "env" {
+		t.Errorf("Option value not taken from env: %v", value)
+	}
+
+	_, err = parser.Parse([]string{"-o", "arg"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if value != "arg" {
+		t.Errorf("Command line didn't take precedence over env: %v", value)
+	}
+}
+
+func TestEnvSwitch(t *testing.T) {
+	defer os.Unsetenv("SUBCOMMAND_TEST_SWITCH")
+	parser := NewParser("test")
+	visited := false
+	parser.AddSwitch("switch", "s", "", func(string, string) error {
+		visited = true
+		return nil
+	}).Env("SUBCOMMAND_TEST_SWITCH")
+
+	os.Setenv("SUBCOMMAND_TEST_SWITCH", "no")
+	parser.Parse([]string{})
+	if visited {
+		t.Error("Switch activated with a non truthy value")
+	}
+	os.Setenv("SUBCOMMAND_TEST_SWITCH", "yes")
+	parser.Parse([]string{})
+	if !visited {
+		t.Error("Switch not activated from env")
+	}
+}
+
+func TestShortSwitchCluster(t *testing.T) {
+	parser := NewParser("test")
+	visited := map[string]bool{}
+	fn := func(name, val string) error {
+		visited[name] = true
+		return nil
+	}
+	parser.AddSwitch("all", "a", "", fn)
+	parser.AddSwitch("brief", "b", "", fn)
+	parser.AddOption("option", "o", "", "", "", fn)
+	_, err := parser.Parse([]string{"-ab"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !visited["all"] || !visited["brief"] {
+		t.Errorf("Cluster wasn't processed %v", visited)
+	}
+	_, err = parser.Parse([]string{"-ax"})
+	if err == nil {
+		t.Error("Unknown switch in cluster didn't complain")
+	}
+}
+
+func TestShortOptionValue(t *testing.T) {
+	parser := NewParser("test")
+	values := map[string]string{}
+	fn := func(name, val string) error {
+		values[name] = val
+		return nil
+	}
+	parser.AddSwitch("verbose", "v", "", fn)
+	parser.AddOption("output", "o", "", "", "", fn)
+	for _, args := range [][]string{{"-ofoo"}, {"-vofoo"}, {"-vo", "foo"}} {
+		values = map[string]string{}
+		if _, err := parser.Parse(args); err != nil {
+			t.Errorf("Unexpected error %v for %v", err, args)
+		}
+		if values["output"] != "foo" || (args[0] != "-ofoo" && len(values) != 2) {
+			t.Errorf("Wrong values %v for %v", values, args)
+		}
+	}
+	_, err := parser.Parse([]string{"-vo"})
+	if e, ok := err.(MissingValueError); !ok || e.Flag != "-o" {
+		t.Errorf("Expected MissingValueError got %v", err)
+	}
+}
+
+func TestCountSwitch(t *testing.T) {
+	parser := NewParser("test")
+	count := 0
+	calls := 0
+	parser.AddCountSwitch("verbose", "v", "", func(name string, c int) error {
+		if name == "verbose" {
+			count = c
+		}
+		calls++
+		return nil
+	})
+	_, err := parser.Parse([]string{"-vv", "--verbose"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Wrong count %v", count)
+	}
+	if calls != 1 {
+		t.Errorf("Count switch called %v times", calls)
+	}
+}
+
+func TestDeprecatedFlag(t *testing.T) {
+	buf := new(bytes.Buffer)
+	errOutput = buf
+	defer func() { errOutput = os.Stderr }()
+	parser := NewParser("test")
+	visited := false
+	parser.AddSwitch("old", "o", "", func(string, string) error {
+		visited = true
+		return nil
+	}).Deprecated("use --new instead")
+	parser.AddSwitch("new", "n", "", emptyFn)
+
+	_, err := parser.Parse([]string{"--old", "-o", "-no"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !visited {
+		t.Error("Deprecated flag wasn't processed")
+	}
+	if res := buf.String(); strings.Count(res, "use --new instead") != 3 || !strings.Contains(res, "--old is deprecated") {
+		t.Errorf("Wrong deprecation warnings %q", res)
+	}
+	//the arguments checked beforehand are not warned about
+	buf.Reset()
+	parser.CollectErrors(true)
+	if _, err := parser.Parse([]string{"--old", "-no"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if res := buf.String(); strings.Count(res, "use --new instead") != 2 {
+		t.Errorf("Wrong deprecation warnings collecting errors %q", res)
+	}
+	//every parser can have its own error output
+	own := new(bytes.Buffer)
+	buf.Reset()
+	parser.SetErrorOutput(own)
+	other := NewParser("other")
+	other.AddSwitch("old", "", "", emptyFn).Deprecated("use --new instead")
+	parser.Parse([]string{"--old"})
+	other.Parse([]string{"--old"})
+	if strings.Count(own.String(), "deprecated") != 1 || strings.Count(buf.String(), "deprecated") != 1 {
+		t.Errorf("Wrong error outputs %q %q", own.String(), buf.String())
+	}
+}
+
+func TestMultiCharShort(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with a multi character short definition")
+		}
+	}()
+	parser := NewParser("test")
+	parser.AddCommand("command", "", "", emptyFnMult).AddSwitch("verbose", "verbose", "", emptyFn)
+}
+
+func TestAllowMultiCharShorts(t *testing.T) {
+	parser := NewParser("test")
+	parser.AllowMultiCharShorts(true)
+	visited := false
+	parser.AddCommand("command", "", "", emptyFnMult).AddSwitch("verbose", "vb", "", func(string, string) error {
+		visited = true
+		return nil
+	})
+	_, err := parser.Parse([]string{"command", "-vb"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !visited {
+		t.Error("Multi character short wasn't processed")
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	parser := NewParser("test")
+	parser.CaseInsensitive(true)
+	var flagName, cmdName string
+	parser.AddCommand("Status", "", "", func(command string, args ...string) error {
+		cmdName = command
+		return nil
+	}).AddSwitch("verbose", "v", "", func(name, val string) error {
+		flagName = name
+		return nil
+	})
+	_, err := parser.Parse([]string{"STATUS", "--Verbose"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if cmdName != "Status" || flagName != "verbose" {
+		t.Errorf("Wrong names command: %v flag: %v", cmdName, flagName)
+	}
+	_, err = parser.Parse([]string{"status", "-V"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCaseInsensitiveDuplicates(t *testing.T) {
+	parser := NewParser("test")
+	parser.CaseInsensitive(true)
+	parser.AddCommand("foo", "", "", emptyFnMult)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with commands differing in case")
+		}
+	}()
+	parser.AddCommand("Foo", "", "", emptyFnMult)
+}
+
+func TestCaseSensitiveByDefault(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	_, err := parser.Parse([]string{"--Verbose"})
+	if err == nil {
+		t.Error("Flags matched ignoring case by default")
+	}
+}
+
+func TestVisitedFlags(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddSwitch("switch", "s", "", emptyFn)
+	parser.AddOption("unused", "u", "", "", "", emptyFn)
+	parser.AddCommand("command", "", "", emptyFnMult).AddOption("option", "o", "", "", "", emptyFn)
+	_, err := parser.Parse([]string{"-s", "command", "--option", "value"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	visited := parser.VisitedFlags()
+	if len(visited) != 2 {
+		t.Fatalf("Wrong number of visited flags %v", visited)
+	}
+	if visited[0].Flag.Long != "switch" || visited[0].Value != "" || visited[0].Command != "test" {
+		t.Errorf("Wrong visited switch %v", visited[0])
+	}
+	if visited[1].Flag.Long != "option" || visited[1].Value != "value" || visited[1].Command != "command" {
+		t.Errorf("Wrong visited option %v", visited[1])
+	}
+	parser.Parse([]string{"command"})
+	if len(parser.VisitedFlags()) != 0 {
+		t.Errorf("Visited flags kept from a previous parsing %v", parser.VisitedFlags())
+	}
+}
+
+func TestValidateFlag(t *testing.T) {
+	parser := NewParser("test")
+	var validations []string
+	called := false
+	parser.AddOption("option", "o", "", "", "", func(string, string) error {
+		called = true
+		return nil
+	}).Validate(func(value string) error {
+		validations = append(validations, "first")
+		return nil
+	}).Validate(func(value string) error {
+		validations = append(validations, "second")
+		if value != "good" {
+			return errors.New("not good")
+		}
+		return nil
+	})
+
+	_, err := parser.Parse([]string{"-o", "bad"})
+	if e, ok := err.(ValidationError); !ok || e.Flag != "option" || e.Value != "bad" {
+		t.Fatalf("Expected ValidationError got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "--option") || !strings.Contains(err.Error(), "not good") {
+		t.Errorf("Error not annotated with the flag name: %v", err)
+	}
+	if called {
+		t.Error("Flag function called after a failed validation")
+	}
+	if strings.Join(validations, " ") != "first second" {
+		t.Errorf("Validations not executed in order %v", validations)
+	}
+
+	_, err = parser.Parse([]string{"-o", "good"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !called {
+		t.Error("Flag function not called")
+	}
+}
+
+func TestTypedOptions(t *testing.T) {
+	parser := NewParser("test")
+	var f float64
+	var b bool
+	parser.AddFloatOption("ratio", "r", "", func(name string, value float64) error {
+		f = value
+		return nil
+	})
+	parser.AddBoolOption("enabled", "e", "", func(name string, value bool) error {
+		b = value
+		return nil
+	}).Must(true)
+
+	_, err := parser.Parse([]string{"-r", "0.5", "--enabled", "true"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if f != 0.5 || !b {
+		t.Errorf("Wrong typed values %v %v", f, b)
+	}
+
+	_, err = parser.Parse([]string{"-r", "half", "--enabled", "true"})
+	if err == nil || err.Error() != `invalid value "half" for --ratio: expected a floating point number` {
+		t.Errorf("Wrong float error %v", err)
+	}
+	_, err = parser.Parse([]string{"--enabled", "maybe"})
+	if err == nil || err.Error() != `invalid value "maybe" for --enabled: expected a boolean` {
+		t.Errorf("Wrong bool error %v", err)
+	}
+	_, err = parser.Parse([]string{"-r", "1"})
+	if _, ok := err.(MissingMandatoryError); !ok {
+		t.Errorf("Mandatory typed option didn't complain %v", err)
+	}
+}
+
+func TestMapOption(t *testing.T) {
+	parser := NewParser("test")
+	defines := make(map[string]string)
+	parser.AddMapOption("define", "D", "", func(name, key, value string) error {
+		defines[key] = value
+		return nil
+	})
+
+	_, err := parser.Parse([]string{"-D", "name=test", "--define", "expr=a=b", "-D", "empty="})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(defines) != 3 || defines["name"] != "test" || defines["expr"] != "a=b" || defines["empty"] != "" {
+		t.Errorf("Wrong pairs %v", defines)
+	}
+	_, err = parser.Parse([]string{"-D", "name"})
+	if e, ok := err.(ValidationError); !ok || !strings.Contains(e.Error(), "expected a key=value pair") {
+		t.Errorf("Expected ValidationError got %v", err)
+	}
+}
+
+func TestReaderOption(t *testing.T) {
+	file, err := ioutil.TempFile("", "subcommand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("from file")
+	file.Close()
+	stdin = strings.NewReader("from stdin")
+	defer func() { stdin = os.Stdin }()
+
+	var read string
+	parser := NewParser("test")
+	parser.AddReaderOption("input", "i", "", func(name string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		read = string(data)
+		return err
+	})
+	for _, c := range [][2]string{{file.Name(), "from file"}, {"-", "from stdin"}} {
+		if _, err := parser.Parse([]string{"-i", c[0]}); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if read != c[1] {
+			t.Errorf("Wrong contents %q for %v", read, c[0])
+		}
+	}
+	if _, err := parser.Parse([]string{"-i", file.Name() + ".missing"}); err == nil {
+		t.Error("Missing file didn't complain")
+	}
+	plain := parser.AddOption("plain", "", "", "", "", nil)
+	if _, err := plain.Open("-"); err == nil || !IsStdin("-") {
+		t.Error("Stdin opened without being allowed")
+	}
+}
+
+func TestListOption(t *testing.T) {
+	var tags, paths []string
+	calls := 0
+	parser := NewParser("test")
+	parser.AddListOption("tags", "t", "", "", func(name string, values []string) error {
+		tags = values
+		calls++
+		return nil
+	})
+	parser.AddListOption("path", "p", "", ":", func(name string, values []string) error {
+		paths = values
+		return nil
+	})
+	_, err := parser.Parse([]string{"--tags", "a, b,,c", "-p", "/bin:/usr/bin", "-t", "d"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(tags, "|") != "a|b|c|d" || calls != 1 || strings.Join(paths, "|") != "/bin|/usr/bin" {
+		t.Errorf("Wrong lists %q %q called %v times", tags, paths, calls)
+	}
+}
+
+func TestParseGlobalFlagFallbacks(t *testing.T) {
+	parser := NewParser("test")
+	var levels []string
+	level := parser.AddOption("level", "l", "", "", "", func(name, val string) error {
+		levels = append(levels, val)
+		return nil
+	}).Default("1")
+	parser.AddOption("config", "c", "", "", "", emptyFn).Must(true)
+	parser.AddCommand("command", "", "", emptyFnMult)
+
+	if _, err := parser.Parse([]string{"-c", "file", "command", "--level", "5"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(levels, ",") != "5" || level.Count() != 1 || len(parser.VisitedFlags()) != 2 {
+		t.Errorf("The default was used for the flag after the command %v %v %v", levels, level.Count(), parser.VisitedFlags())
+	}
+	levels = nil
+	if _, err := parser.Parse([]string{"command", "-c", "file"}); err != nil {
+		t.Errorf("The mandatory flag after the command wasn't accepted %v", err)
+	}
+	if strings.Join(levels, ",") != "1" {
+		t.Errorf("The default wasn't used %v", levels)
+	}
+	if _, err := parser.Parse([]string{"command"}); err == nil {
+		t.Errorf("Missing mandatory flag didn't complain")
+	}
+}
+
+func TestDurationOption(t *testing.T) {
+	parser := NewParser("test")
+	var d time.Duration
+	parser.AddDurationOption("timeout", "t", "", func(name string, value time.Duration) error {
+		d = value
+		return nil
+	}).Must(true)
+
+	_, err := parser.Parse([]string{"--timeout", "30s"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if d != 30*time.Second {
+		t.Errorf("Wrong duration %v", d)
+	}
+	_, err = parser.Parse([]string{"--timeout", "soon"})
+	if err == nil || err.Error() != `invalid value "soon" for --timeout: expected a duration` {
+		t.Errorf("Wrong duration error %v", err)
+	}
+	_, err = parser.Parse([]string{})
+	if _, ok := err.(MissingMandatoryError); !ok {
+		t.Errorf("Mandatory duration option didn't complain %v", err)
+	}
+}
+
+func TestParseGlobalFlagAfterCommand(t *testing.T) {
+	parser := NewParser("test")
+	var global, inner string
+	parser.AddSwitch("debug", "d", "", func(name, val string) error {
+		global = name
+		return nil
+	})
+	parser.AddOption("output", "o", "", "", "", func(name, val string) error {
+		global = "global " + val
+		return nil
+	})
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	cmd.AddOption("output", "o", "", "", "", func(name, val string) error {
+		inner = val
+		return nil
+	})
+	_, err := parser.Parse([]string{"command", "--debug"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if global != "debug" {
+		t.Errorf("Global flag after the command not processed %v", global)
+	}
+	global = ""
+	_, err = parser.Parse([]string{"command", "-o", "file"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if inner != "file" || global != "" {
+		t.Errorf("Command flag didn't shadow the global one inner: %v global: %v", inner, global)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	parser := NewParser("test")
+	parser.CollectErrors(true)
+	called := false
+	parser.AddSwitch("switch", "s", "", func(string, string) error {
+		called = true
+		return nil
+	})
+	parser.AddOption("mandatory", "m", "", "", "", emptyFn).Must(true)
+	cmd := parser.AddCommand("command", "", "", func(string, ...string) error {
+		called = true
+		return nil
+	})
+	cmd.AddOption("option", "o", "", "", "", emptyFn)
+
+	_, err := parser.Parse([]string{"-s", "--nanana", "command", "-x", "-o"})
+	errs, ok := err.(ParsingErrors)
+	if !ok {
+		t.Fatalf("Expected ParsingErrors got %#v", err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("Wrong number of errors %v", errs)
+	}
+	for idx, e := range []interface{}{UnknownFlagError{}, MissingMandatoryError{}, UnknownFlagError{}, MissingValueError{}} {
+		if idx < len(errs) && fmt.Sprintf("%T", errs[idx]) != fmt.Sprintf("%T", e) {
+			t.Errorf("Expected %T got %T", e, errs[idx])
+		}
+	}
+	if called {
+		t.Error("Functions called while collecting errors")
+	}
+	if strings.Count(err.Error(), "\n") != 3 {
+		t.Errorf("Errors not joined %q", err.Error())
+	}
+
+	_, err = parser.Parse([]string{"-s", "-m", "val", "command", "-o", "opt"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !called {
+		t.Error("Functions not called after a successful check")
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	parser := NewParser("test")
+	option := parser.AddOption("option", "o", "", "", "", emptyFn)
+	sw := parser.AddSwitch("switch", "s", "", emptyFn)
+	unused := parser.AddOption("unused", "u", "", "", "", emptyFn)
+	_, err := parser.Parse([]string{"-o", "first", "-s", "--option", "second"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if !option.WasSet() || option.Value() != "second" {
+		t.Errorf("Wrong option value %v %v", option.WasSet(), option.Value())
+	}
+	if !sw.WasSet() || sw.Value() != "" {
+		t.Errorf("Wrong switch value %v %v", sw.WasSet(), sw.Value())
+	}
+	if unused.WasSet() {
+		t.Error("Unused flag set")
+	}
+	parser.Parse([]string{})
+	if option.WasSet() || option.Value() != "" {
+		t.Error("Value kept from a previous parsing")
+	}
+}
+
+func TestConcurrentParse(t *testing.T) {
+	parser := NewParser("test")
+	command := parser.AddCommand("command", "", "", emptyFnMult)
+	option := command.AddOption("option", "o", "", "", "", emptyFn)
+	done := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			_, err := parser.Parse([]string{"command", "-o", fmt.Sprint(i), "arg"})
+			option.Value()
+			parser.VisitedFlags()
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if !option.WasSet() || len(parser.VisitedFlags()) != 1 {
+		t.Errorf("Wrong results %v %v", option.WasSet(), parser.VisitedFlags())
+	}
+}
+
+func TestExecutedCommands(t *testing.T) {
+	parser := NewParser("test")
+	command := parser.AddCommand("command", "", "", emptyFnMult)
+	parser.AddCommand("other", "", "", emptyFnMult)
+	if _, err := parser.Parse([]string{"command", "arg"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	executed := parser.ExecutedCommands()
+	if len(executed) != 2 || executed[0] != &parser.Command || executed[1] != command {
+		t.Errorf("Wrong executed commands %v", executed)
+	}
+	command.SetArity(0, "")
+	parser.Parse([]string{"command", "arg"})
+	if executed := parser.ExecutedCommands(); len(executed) != 1 {
+		t.Errorf("Failed command reported as executed %v", executed)
+	}
+}
+
+func TestLeftOversByCommand(t *testing.T) {
+	parser := NewParser("test")
+	parser.OnCommand(emptyFnMult)
+	command := parser.AddCommand("command", "", "", emptyFnMult)
+	if _, err := parser.Parse([]string{"left1", "left2", "command", "arg"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	executed := parser.LeftOversByCommand()
+	if len(executed) != 2 || executed[0].Command != &parser.Command || executed[1].Command != command {
+		t.Fatalf("Wrong executed commands %v", executed)
+	}
+	if fmt.Sprint(executed[0].LeftOvers) != "[left1 left2]" || fmt.Sprint(executed[1].LeftOvers) != "[arg]" {
+		t.Errorf("Wrong leftovers %v %v", executed[0].LeftOvers, executed[1].LeftOvers)
+	}
+}
+
+func TestAllFlags(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "global", emptyFn)
+	parser.AddOption("output", "o", "global", "", "", emptyFn)
+	parser.AddSwitch("quiet", "q", "global", emptyFn)
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	cmd.AddOption("output", "O", "inner", "", "", emptyFn)
+	cmd.AddSwitch("", "q", "inner", emptyFn)
+	var names []string
+	for _, f := range cmd.AllFlags() {
+		names = append(names, f.name()+":"+f.ShortDesc)
+	}
+	if fmt.Sprint(names) != "[output:inner q:inner verbose:global]" {
+		t.Errorf("Wrong flags %v", names)
+	}
+	if len(parser.AllFlags()) != 3 {
+		t.Errorf("Wrong parser flags %v", parser.AllFlags())
+	}
+}
+
+func TestInvokedCommand(t *testing.T) {
+	parser := NewParser("test")
+	parser.SetOutput(ioutil.Discard)
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	command := parser.AddCommand("command", "", "", emptyFnMult)
+	if _, err := parser.Parse([]string{"-v", "command"}); err != nil || parser.InvokedCommand() != command {
+		t.Errorf("Wrong invoked command %v (%v)", parser.InvokedCommand(), err)
+	}
+	if _, err := parser.Parse([]string{"-v"}); err != nil || parser.InvokedCommand() != nil {
+		t.Errorf("Wrong invoked command %v (%v)", parser.InvokedCommand(), err)
+	}
+	if _, err := parser.Parse([]string{"help"}); err != nil || parser.InvokedCommand() == nil || parser.InvokedCommand().Name != "help" {
+		t.Errorf("Wrong invoked command %v (%v)", parser.InvokedCommand(), err)
+	}
+	parser.Parse([]string{"--unknown"})
+	if parser.InvokedCommand() != nil {
+		t.Errorf("Invoked command after a failure %v", parser.InvokedCommand())
+	}
+}
+
+func TestPlan(t *testing.T) {
+	called := false
+	fn := func(string, string) error {
+		called = true
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", fn)
+	cmd := parser.AddCommand("copy", "", "", func(string, ...string) error {
+		called = true
+		return nil
+	}).SetArity(2, "SRC DST")
+	cmd.AddOption("mode", "m", "", "", "", fn).Must(true)
+	cmd.AddOption("level", "l", "", "", "", fn).Default("3")
+
+	plan, err := parser.Plan([]string{"-v", "copy", "-m", "fast", "a", "b"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if called {
+		t.Error("Functions called while planning")
+	}
+	if len(plan.Commands) != 2 || plan.Commands[1].Command != cmd || fmt.Sprint(plan.Commands[1].LeftOvers) != "[a b]" {
+		t.Errorf("Wrong commands %v", plan.Commands)
+	}
+	var flags []string
+	for _, f := range plan.Flags {
+		flags = append(flags, f.Command+":"+f.Flag.name()+"="+f.Value)
+	}
+	if fmt.Sprint(flags) != "[test:verbose= copy:mode=fast copy:level=3]" {
+		t.Errorf("Wrong flags %v", flags)
+	}
+	if len(parser.VisitedFlags()) != 0 || len(parser.ExecutedCommands()) != 0 {
+		t.Errorf("Results modified")
+	}
+	for _, args := range [][]string{{"--unknown"}, {"copy", "a", "b"}, {"copy", "-m", "x", "a"}} {
+		if _, err := parser.Plan(args); err == nil {
+			t.Errorf("No error planning %v", args)
+		}
+	}
+	parser.CollectErrors(true)
+	if _, err := parser.Plan([]string{"copy", "--unknown", "a"}); len(err.(ParsingErrors)) != 3 {
+		t.Errorf("Wrong errors %v", err)
+	}
+	//nothing is written for the deprecated flags either
+	buf := new(bytes.Buffer)
+	errOutput = buf
+	defer func() { errOutput = os.Stderr }()
+	parser.AddSwitch("old", "", "", fn).Deprecated("use --verbose")
+	if _, err := parser.Plan([]string{"--old"}); err != nil || buf.Len() != 0 {
+		t.Errorf("Deprecation warned while planning %q (%v)", buf.String(), err)
+	}
+}
+
+func TestOnUnknownCommand(t *testing.T) {
+	var external []string
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	parser.AddCommand("known", "", "", emptyFnMult)
+	parser.OnUnknownCommand(func(name string, args ...string) error {
+		external = append([]string{name}, args...)
+		return nil
+	})
+	if _, err := parser.Parse([]string{"-v", "lint", "--fix", "dir"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(external) != "[lint --fix dir]" {
+		t.Errorf("Wrong external command %v", external)
+	}
+	external = nil
+	if _, err := parser.Parse([]string{"known", "arg"}); err != nil || external != nil {
+		t.Errorf("Handler called for a known command %v (%v)", external, err)
+	}
+	if _, err := parser.Plan([]string{"lint"}); err != nil || external != nil {
+		t.Errorf("Handler called planning %v (%v)", external, err)
+	}
+	parser.StrictCommands(true)
+	if _, err := parser.Parse([]string{"lint"}); err == nil || external != nil {
+		t.Errorf("Handler called in strict mode %v (%v)", external, err)
+	}
+}
+
+func TestNilFlagFunction(t *testing.T) {
+	parser := NewParser("test")
+	option := parser.AddOption("option", "o", "", "", "", nil)
+	sw := parser.AddSwitch("switch", "s", "", nil)
+	if _, err := parser.Parse([]string{"-o", "val", "-s"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if option.Value() != "val" || !sw.WasSet() {
+		t.Errorf("Values not recorded %q %v", option.Value(), sw.WasSet())
+	}
+}
+
+func TestNargs(t *testing.T) {
+	var point string
+	parser := NewParser("test")
+	parser.AddOption("point", "p", "", "", "", func(name, value string) error {
+		point = value
+		return nil
+	}).Nargs(2)
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	parser.SetArity(-1, "")
+	if _, err := parser.Parse([]string{"--point", "1", "-2", "arg"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if point != "1 -2" {
+		t.Errorf("Wrong values %q", point)
+	}
+	for _, args := range [][]string{{"-p", "1"}, {"-p", "1", "-v"}, {"-p", "1", "--", "2"}} {
+		if _, err := parser.Parse(args); fmt.Sprintf("%T", err) != "subcommand.MissingValueError" {
+			t.Errorf("Expected MissingValueError for %v got %v", args, err)
+		}
+	}
+}
+
+func TestConsumerFlag(t *testing.T) {
+	var execArgs []string
+	parser := NewParser("test")
+	exec := parser.AddConsumerFlag("exec", "e", "", func(name string, args []string) (int, error) {
+		for i, arg := range args {
+			if arg == ";" {
+				execArgs = args[:i]
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("%v not terminated by ;", name)
+	})
+	verbose := parser.AddSwitch("verbose", "v", "", nil)
+	parser.SetArity(-1, "")
+	if _, err := parser.Parse([]string{"--exec", "rm", "-v", "{}", ";", "-v"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(execArgs, " ") != "rm -v {}" || exec.Value() != "rm -v {} ;" || !verbose.WasSet() {
+		t.Errorf("Wrong arguments consumed %v %q %v", execArgs, exec.Value(), verbose.WasSet())
+	}
+	if _, err := parser.Parse([]string{"-e", "rm"}); err == nil || err.Error() != "exec not terminated by ;" {
+		t.Errorf("Expected consumer error got %v", err)
+	}
+	parser.AddConsumerFlag("greedy", "", "", func(string, []string) (int, error) { return 10, nil })
+	if _, err := parser.Parse([]string{"--greedy", "a"}); err == nil {
+		t.Error("Consumed more arguments than available")
+	}
+}
+
+func TestNargsSwitch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Not panicked with a switch")
+		}
+	}()
+	NewParser("test").AddSwitch("switch", "s", "", emptyFn).Nargs(2)
+}
+
+func TestPosixMode(t *testing.T) {
+	var params []string
+	parser := NewParser("test")
+	verbose := parser.AddSwitch("verbose", "v", "", nil)
+	parser.AddCommand("command", "", "", func(name string, args ...string) error {
+		params = args
+		return nil
+	}).AddSwitch("force", "f", "", nil)
+	parser.PosixMode(true)
+	if _, err := parser.Parse([]string{"-v", "command", "file", "-f", "--help", "command"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(params, " ") != "file -f --help command" || !verbose.WasSet() {
+		t.Errorf("Wrong leftovers %v", params)
+	}
+}
+
+func TestDefaultCommand(t *testing.T) {
+	var executed []string
+	var params []string
+	parser := NewParser("test")
+	parser.OnCommand(func(name string, args ...string) error {
+		executed = append(executed, name)
+		return nil
+	})
+	parser.AddCommand("status", "", "", func(name string, args ...string) error {
+		executed = append(executed, name)
+		params = args
+		return nil
+	}).SetDefault()
+	parser.AddCommand("other", "", "", func(name string, args ...string) error {
+		executed = append(executed, name)
+		return nil
+	})
+	if _, err := parser.Parse([]string{"file"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(executed, ",") != "test,status" || strings.Join(params, ",") != "file" {
+		t.Errorf("Wrong execution %v %v", executed, params)
+	}
+	executed = nil
+	if _, err := parser.Parse([]string{"other"}); err != nil || strings.Join(executed, ",") != "test,other" {
+		t.Errorf("Wrong execution %v %v", executed, err)
+	}
+	parser.SetDefaultCommand("nonexistent")
+	if _, err := parser.Parse([]string{}); err == nil {
+		t.Error("Nonexistent default command accepted")
+	}
+}
+
+func TestResponseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subcommand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "args")
+	ioutil.WriteFile(file, []byte("-o 'a value'\n  command\t\"x y\" ''\n"), 0644)
+	nested := filepath.Join(dir, "nested")
+	ioutil.WriteFile(nested, []byte("@"+file), 0644)
+
+	var option string
+	var params []string
+	parser := NewParser("test")
+	parser.AddOption("option", "o", "", "", "", func(name, value string) error {
+		option = value
+		return nil
+	})
+	parser.AddCommand("command", "", "", func(name string, args ...string) error {
+		params = args
+		return nil
+	})
+	if _, err := parser.Parse([]string{"@" + file}); err == nil {
+		t.Error("Response file expanded without enabling it")
+	}
+	parser.ExpandResponseFiles(true)
+	if _, err := parser.Parse([]string{"@" + file, "z"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if option != "a value" || len(params) != 3 || params[0] != "x y" || params[1] != "" || params[2] != "z" {
+		t.Errorf("Wrong arguments %q %q", option, params)
+	}
+	for _, arg := range []string{"@" + nested, "@" + filepath.Join(dir, "missing")} {
+		if _, err := parser.Parse([]string{arg}); err == nil || !strings.Contains(err.Error(), "response file") {
+			t.Errorf("Expected a response file error for %v got %v", arg, err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for text, expected := range map[string]string{
+		`--message "hello world"`: `["--message" "hello world"]`,
+		`a\ b 'c\ d' "e\"f" \'g`:  `["a b" "c\\ d" "e\"f" "'g"]`,
+		"one\\\ntwo \"\" x\\\\":   `["one\ntwo" "" "x\\"]`,
+		"  \t\n":                  `[]`,
+	} {
+		args, err := splitArgs(text)
+		if err != nil {
+			t.Errorf("Unexpected error %v for %q", err, text)
+		}
+		if res := fmt.Sprintf("%q", args); res != expected {
+			t.Errorf("Wrong arguments %v for %q", res, text)
+		}
+	}
+	for text, message := range map[string]string{
+		`"open`:     "unterminated quote \"",
+		`'open`:     "unterminated quote '",
+		`trailing\`: "unterminated escape at the end",
+	} {
+		if _, err := splitArgs(text); err == nil || err.Error() != message {
+			t.Errorf("Expected %q got %v for %q", message, err, text)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	var calls []string
+	parser := NewParser("program")
+	parser.AddCommand("say", "", "", func(cmd string, args ...string) error {
+		calls = append(calls, strings.Join(args, "|"))
+		return nil
+	}).SetArity(-1, "")
+	parser.AddSwitch("verbose", "v", "", func(string, string) error {
+		calls = append(calls, "verbose")
+		return nil
+	})
+	script := "# greetings\nsay hello\n\n  -v say 'big world'\n   # done\n"
+	if err := parser.ParseScript(strings.NewReader(script)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res := strings.Join(calls, ","); res != "hello,verbose,big world" {
+		t.Errorf("Wrong calls %v", res)
+	}
+
+	calls = nil
+	err := parser.ParseScript(strings.NewReader("say one\n--unknown\nsay two\n"))
+	var scriptErr ScriptError
+	var flagErr UnknownFlagError
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 2 || !errors.As(err, &flagErr) {
+		t.Errorf("Expected an unknown flag error at line 2, got %v", err)
+	}
+	if res := strings.Join(calls, ","); res != "one" {
+		t.Errorf("The script should stop at the failing line, got %v", res)
+	}
+	err = parser.ParseScript(strings.NewReader("say one\nsay 'open\n"))
+	if err == nil || err.Error() != "line 2: unterminated quote '" {
+		t.Errorf("Expected the tokenizing error at line 2, got %v", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	values := map[string]string{}
+	fn := func(name, value string) error {
+		values[name] = value
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddOption("cli", "", "", "", "", fn).Default("default")
+	parser.AddOption("env", "", "", "", "", fn).Env("SUBCOMMAND_TEST_DEFAULT").Default("default")
+	parser.AddOption("config", "", "", "", "", fn).Default("default")
+	parser.AddOption("programmatic", "", "", "", "", fn).Default("default")
+	verbose := parser.AddSwitch("verbose", "", "", fn)
+	parser.AddCommand("command", "", "", emptyFnMult).AddOption("inner", "", "", "", "", fn)
+	os.Setenv("SUBCOMMAND_TEST_DEFAULT", "env")
+	defer os.Unsetenv("SUBCOMMAND_TEST_DEFAULT")
+
+	err := parser.LoadDefaults(strings.NewReader(`{"cli": "config", "env": "config", "config": 1.5, "verbose": true, "command": {"inner": "config"}}`))
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err = parser.Parse([]string{"--cli", "cli", "command"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	expected := map[string]string{"cli": "cli", "env": "env", "config": "1.5", "programmatic": "default", "verbose": "", "inner": "config"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) || !verbose.WasSet() {
+		t.Errorf("Wrong precedence %v", values)
+	}
+	for _, config := range []string{`{"unknown": "x"}`, `{"command": {"cli": "x"}}`, `{"cli": ["x"]}`, `{"cli"`} {
+		if err := parser.LoadDefaults(strings.NewReader(config)); err == nil {
+			t.Errorf("Wrong defaults %v accepted", config)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddCommand("zero", "", "", emptyFnMult)
+	parser.AddCommand("one", "", "", emptyFnMult).Hidden(true)
+	var visited []string
+	parser.Walk(func(cmd *Command, depth int) {
+		visited = append(visited, fmt.Sprintf("%v:%v:%v", cmd.Name, depth, cmd.IsHidden()))
+	})
+	if res := strings.Join(visited, " "); res != "test:0:false one:1:true zero:1:false" {
+		t.Errorf("Wrong traversal %v", res)
+	}
+}
+
+func TestFormFunction(t *testing.T) {
+	var forms []bool
+	fn := func(name, value string, short bool) error {
+		forms = append(forms, short)
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddOption("option", "o", "", "", "", nil).FormFunction(fn)
+	parser.AddSwitch("switch", "s", "", nil).FormFunction(fn)
+	parser.AddSwitch("verbose", "v", "", nil).FormFunction(fn)
+	if _, err := parser.Parse([]string{"-o", "a", "--option", "b", "-sv", "--switch"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(forms) != "[true false true true false]" {
+		t.Errorf("Wrong forms %v", forms)
+	}
+}
+
+func TestDuplicatedFlags(t *testing.T) {
+	for _, c := range []struct {
+		long, short, message string
+	}{
+		{"verbose", "x", "Long definition --verbose of flag verbose already used by flag verbose in command test"},
+		{"version", "v", "Short definition -v of flag version already used by flag verbose in command test"},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || fmt.Sprint(r) != c.message {
+					t.Errorf("Expected panic %q got %v", c.message, r)
+				}
+			}()
+			parser := NewParser("test")
+			parser.AddSwitch("verbose", "v", "", emptyFn)
+			parser.AddSwitch(c.long, c.short, "", emptyFn)
+		}()
+	}
+}
+
+func TestTryAddFlags(t *testing.T) {
+	parser := NewParser("test")
+	if flag, err := parser.TryAddSwitch("verbose", "v", "", emptyFn); err != nil || flag.Long != "verbose" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := parser.TryAddOption("verbose", "x", "", "", "", emptyFn); err == nil ||
+		err.Error() != "Long definition --verbose of flag verbose already used by flag verbose in command test" {
+		t.Errorf("Wrong error %v", err)
+	}
+	if _, err := parser.TryAddSwitch("version", "v", "", emptyFn); err == nil {
+		t.Errorf("Duplicated short definition accepted")
+	}
+	if _, err := parser.TryAddOption("output", "out", "", "", "", emptyFn); err == nil {
+		t.Errorf("Long short definition accepted")
+	}
+	if len(parser.Flags()) != 1 {
+		t.Errorf("Failed flags added %v", parser.Flags())
+	}
+}
+
+func TestFlagError(t *testing.T) {
+	failure := errors.New("disk full")
+	parser := NewParser("test")
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	cmd.AddOption("output", "o", "", "", "", func(string, string) error { return failure })
+	cmd.AddSwitch("", "q", "", func(string, string) error { return failure })
+	_, err := parser.Parse([]string{"command", "-o", "out"})
+	if e, ok := err.(FlagError); !ok || e.Flag != "output" || e.Command.Name != "command" {
+		t.Fatalf("Expected FlagError got %#v", err)
+	}
+	if err.Error() != "error processing --output: disk full" {
+		t.Errorf("Wrong message %v", err)
+	}
+	if !errors.Is(err, failure) || errors.Unwrap(err) != failure {
+		t.Errorf("Original error not wrapped")
+	}
+	if _, err = parser.Parse([]string{"command", "-q"}); err == nil || err.Error() != "error processing -q: disk full" {
+		t.Errorf("Wrong message %v", err)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	failure := errors.New("no network")
+	parser := NewParser("test")
+	parser.AddCommand("fetch", "", "", func(string, ...string) error { return failure })
+	parser.AddCommandCtx("push", "", "", func(context.Context, string, ...string) error { return failure })
+	for _, name := range []string{"fetch", "push"} {
+		_, err := parser.Parse([]string{name})
+		if e, ok := err.(CommandError); !ok || e.Command.Name != name {
+			t.Fatalf("Expected CommandError got %#v", err)
+		}
+		if err.Error() != fmt.Sprintf("error running command %q: no network", name) {
+			t.Errorf("Wrong message %v", err)
+		}
+		if !errors.Is(err, failure) || errors.Unwrap(err) != failure {
+			t.Errorf("Original error not wrapped")
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", nil)
+	command := parser.AddCommand("command", "", "", emptyFnMult)
+	command.AddOption("option", "o", "", "", "", nil)
+	command.AddSwitch("force", "f", "", nil)
+
+	_, err := parser.Parse([]string{"-v", "command", "-f", "--unknown"})
+	if e, ok := err.(UnknownFlagError); !ok || e.Pos != 3 {
+		t.Errorf("Expected UnknownFlagError at 3 got %#v", err)
+	}
+	_, err = parser.Parse([]string{"command", "-o"})
+	if e, ok := err.(MissingValueError); !ok || e.Pos != 1 {
+		t.Errorf("Expected MissingValueError at 1 got %#v", err)
+	}
+	_, err = parser.Parse([]string{"-x"})
+	if e, ok := err.(UnknownFlagError); !ok || e.Pos != 0 {
+		t.Errorf("Expected UnknownFlagError at 0 got %#v", err)
+	}
+}
+
+func TestFlagAbbreviations(t *testing.T) {
+	values := map[string]string{}
+	fn := func(name, value string) error {
+		values[name] = value
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "", "", fn)
+	parser.AddSwitch("version", "", "", fn)
+	parser.AddOption("output", "", "", "", "", fn)
+	parser.AddCommand("command", "", "", emptyFnMult).AddSwitch("out", "", "", fn)
+	if _, err := parser.Parse([]string{"--verb"}); err == nil {
+		t.Error("Abbreviation accepted without allowing it")
+	}
+	parser.AllowFlagAbbreviations(true)
+	if _, err := parser.Parse([]string{"--verb", "--outp", "file"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, ok := values["verbose"]; !ok || values["output"] != "file" {
+		t.Errorf("Abbreviations not resolved %v", values)
+	}
+	_, err := parser.Parse([]string{"--ver"})
+	if err == nil || !strings.Contains(err.Error(), "(--verbose, --version)") {
+		t.Errorf("Expected ambiguous error got %v", err)
+	}
+	values = map[string]string{}
+	if _, err := parser.Parse([]string{"command", "--out"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, ok := values["out"]; !ok || len(values) != 1 {
+		t.Errorf("Exact match didn't win %v", values)
+	}
+	if _, err := parser.Parse([]string{"--output", "--verb"}); fmt.Sprintf("%T", err) != "subcommand.MissingValueError" {
+		t.Errorf("Expected MissingValueError got %v", err)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	parser := NewParser("test")
+	command := parser.AddCommand("command", "", "", func(string, ...string) error {
+		return errors.New("failed")
+	})
+	command.AddOption("mandatory", "m", "", "", "", nil).Must(true)
+	command.OnError(func(err error) error {
+		return fmt.Errorf("%v (see test help command)", err)
+	})
+	for _, args := range [][]string{{"command", "--unknown"}, {"command"}, {"command", "-m", "x"}} {
+		if _, err := parser.Parse(args); err == nil || !strings.HasSuffix(err.Error(), "(see test help command)") {
+			t.Errorf("Error not annotated for %v: %v", args, err)
+		}
+	}
+	parser.CollectErrors(true)
+	_, err := parser.Parse([]string{"command", "--unknown"})
+	if errs, ok := err.(ParsingErrors); !ok || len(errs) != 2 || !strings.HasSuffix(errs[1].Error(), "(see test help command)") {
+		t.Errorf("Collected errors not annotated %v", err)
+	}
+	parser.CollectErrors(false)
+	command.OnError(func(error) error { return nil })
+	if _, err := parser.Parse([]string{"command", "-m", "x"}); err != nil {
+		t.Errorf("Error not ignored %v", err)
+	}
+	if _, err := parser.Parse([]string{"--unknown"}); err == nil {
+		t.Error("Parser errors handled by the command")
+	}
+}
+
+func TestFlagCount(t *testing.T) {
+	parser := NewParser("test")
+	verbose := parser.AddSwitch("verbose", "v", "", nil)
+	option := parser.AddOption("option", "o", "", "", "", nil)
+	unused := parser.AddSwitch("unused", "u", "", nil)
+	if _, err := parser.Parse([]string{"-vv", "--verbose", "-o", "a", "-vo", "b"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if verbose.Count() != 4 || option.Count() != 2 || unused.Count() != 0 {
+		t.Errorf("Wrong counts %v %v %v", verbose.Count(), option.Count(), unused.Count())
+	}
+	parser.Parse([]string{})
+	if verbose.Count() != 0 {
+		t.Error("Count kept from a previous parsing")
+	}
+}
+
+func TestParseFrom(t *testing.T) {
+	called := false
+	parser := NewParser("test")
+	parser.AddCommand("command", "", "", func(string, ...string) error {
+		called = true
+		return nil
+	})
+	if _, err := parser.ParseFrom([]string{"/usr/bin/test", "command"}, true); err != nil || !called {
+		t.Errorf("Program name not skipped %v", err)
+	}
+	if _, err := parser.ParseFrom([]string{}, true); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	called = false
+	if _, err := parser.ParseFrom([]string{"command"}, false); err != nil || !called {
+		t.Errorf("Arguments not parsed as they are %v", err)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	for _, args := range [][]string{{}, nil} {
+		var params []string
+		called := false
+		parser := NewParser("test")
+		parser.OnCommand(func(name string, args ...string) error {
+			called = true
+			params = args
+			return nil
+		})
+		parser.AddCommand("command", "", "", emptyFnMult)
+		if _, err := parser.Parse(args); err != nil || !called || len(params) != 0 {
+			t.Errorf("Parser function not called with no arguments %v %v %v", err, called, params)
+		}
+		parser.AddOption("mandatory", "m", "", "", "", nil).Must(true)
+		called = false
+		_, err := parser.Parse(args)
+		if e, ok := err.(MissingMandatoryError); !ok || e.Flag != "mandatory" || called {
+			t.Errorf("Expected MissingMandatoryError got %v", err)
+		}
+	}
+}
+
+func TestInlineValues(t *testing.T) {
+	values := map[string]string{}
+	fn := func(name, value string) error {
+		values[name] = value
+		return nil
+	}
+	parser := NewParser("test")
+	parser.AddSwitch("verbose", "v", "", fn)
+	parser.AddSwitch("force", "f", "", fn)
+	parser.AddSwitch("quiet", "q", "", fn)
+	parser.AddOption("output", "o", "", "", "", fn)
+	parser.AddOption("point", "", "", "", "", fn).Nargs(2)
+	_, err := parser.Parse([]string{"--verbose=true", "--force=0", "--quiet", "--output=a=b"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	expected := map[string]string{"verbose": "true", "force": "false", "quiet": "", "output": "a=b"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Wrong values %v", values)
+	}
+	_, err = parser.Parse([]string{"--verbose=maybe"})
+	if e, ok := err.(ValidationError); !ok || e.Flag != "verbose" || e.Value != "maybe" {
+		t.Errorf("Expected ValidationError got %v", err)
+	}
+	if _, err = parser.Parse([]string{"--output", "--verbose=false"}); fmt.Sprintf("%T", err) != "subcommand.MissingValueError" {
+		t.Errorf("Expected MissingValueError got %v", err)
+	}
+	if _, err = parser.Parse([]string{"--point=1"}); err == nil {
+		t.Error("Several values accepted after =")
+	}
+	if _, err = parser.Parse([]string{"--unknown=1"}); err == nil || err.(UnknownFlagError).Flag != "--unknown" {
+		t.Errorf("Expected UnknownFlagError got %v", err)
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	parser := NewParser("test")
+	cmd := parser.AddCommand("remote", "", "", func(string, ...string) error { return nil })
+	cmd.AddSwitch("verbose", "v", "", func(string, string) error { return nil })
+	cmd.SetArity(1, "NAME")
+	parser.AddCommand("rebase", "", "", func(string, ...string) error { return nil })
+	found, ok := parser.LookupCommand("remote")
+	if !ok || found != cmd {
+		t.Fatalf("Command remote not found")
+	}
+	if len(found.Flags()) != 1 || found.Arity().Min != 1 || found.Parent().Name != "test" {
+		t.Errorf("Unexpected command metadata")
+	}
+	if _, ok := parser.LookupCommand("rem"); ok {
+		t.Errorf("Abbreviation found while not allowed")
+	}
+	parser.AllowAbbreviations(true)
+	if found, ok := parser.LookupCommand("rem"); !ok || found != cmd {
+		t.Errorf("Abbreviation not found")
+	}
+	if _, ok := parser.LookupCommand("re"); ok {
+		t.Errorf("Ambiguous abbreviation found")
+	}
+}
+
+type recorder struct { //handles commands and flags recording the calls
+	calls []string
+}
+
+func (r *recorder) Run(name string, args ...string) error {
+	r.calls = append(r.calls, fmt.Sprintf("%v%v", name, args))
+	return nil
+}
+
+func (r *recorder) Set(name, value string) error {
+	r.calls = append(r.calls, name+"="+value)
+	return nil
+}
+
+func TestHandlers(t *testing.T) {
+	r := &recorder{}
+	parser := NewParser("test")
+	cmd := parser.AddHandler("run", "runs", r)
+	cmd.AddSwitchHandler("verbose", "v", "", r)
+	cmd.AddOptionHandler("output", "o", "", "", "", r)
+	if _, err := parser.Parse([]string{"run", "-v", "-o", "out", "arg"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(r.calls) != "[verbose= output=out run[arg]]" {
+		t.Errorf("Wrong calls %v", r.calls)
+	}
+	if cmd.ShortDesc != "runs" || cmd.LongDesc != "runs" {
+		t.Errorf("Wrong descriptions %q %q", cmd.ShortDesc, cmd.LongDesc)
+	}
+}
+
+func TestBoolFlag(t *testing.T) {
+	var states []bool
+	parser := NewParser("test")
+	flag := parser.AddBoolFlag("cache", "c", "", func(name string, value bool) error {
+		states = append(states, value)
+		return nil
+	})
+	for _, args := range [][]string{{"--cache"}, {"-c"}, {"--cache=true"}, {"--cache=false"}, {"--no-cache"}, {"--cache=0"}} {
+		if _, err := parser.Parse(args); err != nil {
+			t.Errorf("Unexpected error %v for %v", err, args)
+		}
+	}
+	if fmt.Sprint(states) != "[true true true false false false]" {
+		t.Errorf("Wrong states %v", states)
+	}
+	if !flag.WasSet() || flag.Value() != "false" {
+		t.Errorf("Wrong result %v %q", flag.WasSet(), flag.Value())
+	}
+	states = nil
+	for _, args := range [][]string{{"--cache=maybe"}, {"--no-cache=true"}, {"--no-other"}} {
+		if _, err := parser.Parse(args); err == nil {
+			t.Errorf("No error for %v", args)
+		}
+	}
+	if len(states) != 0 {
+		t.Errorf("Function called %v", states)
+	}
+	if prefix := flag.FlagStringPrefix(); prefix != "-c,--[no-]cache" {
+		t.Errorf("Wrong help prefix %v", prefix)
+	}
+
+	//falsy values from the environment and the defaults switch it off
+	flag.Env("TEST_BOOL_FLAG_CACHE")
+	defer os.Unsetenv("TEST_BOOL_FLAG_CACHE")
+	for _, value := range []string{"false", "yes"} {
+		os.Setenv("TEST_BOOL_FLAG_CACHE", value)
+		if _, err := parser.Parse(nil); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	os.Unsetenv("TEST_BOOL_FLAG_CACHE")
+	if err := parser.LoadDefaults(strings.NewReader(`{"cache": false}`)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := parser.Parse(nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(states) != "[false true false]" {
+		t.Errorf("Wrong states from the environment and the defaults %v", states)
+	}
+}
+
+func TestOptionalValue(t *testing.T) {
+	var colors []string
+	parser := NewParser("test")
+	parser.OnCommand(emptyFnMult)
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	parser.AddOption("color", "c", "", "", "", func(name, value string) error {
+		colors = append(colors, value)
+		return nil
+	}).OptionalValue("auto")
+	for _, c := range []struct {
+		args  []string
+		color string
+	}{
+		{[]string{"--color"}, "auto"},
+		{[]string{"--color=never"}, "never"},
+		{[]string{"--color", "never"}, "auto"},
+		{[]string{"-c"}, "auto"},
+		{[]string{"-cnever"}, "never"},
+		{[]string{"-vc"}, "auto"},
+	} {
+		colors = nil
+		if _, err := parser.Parse(c.args); err != nil {
+			t.Errorf("Unexpected error %v for %v", err, c.args)
+		}
+		if len(colors) != 1 || colors[0] != c.color {
+			t.Errorf("Wrong color %v for %v", colors, c.args)
+		}
+	}
+	executed := parser.LeftOversByCommand()
+	if len(executed) != 1 || len(executed[0].LeftOvers) != 0 {
+		t.Errorf("Wrong leftovers %v", executed)
+	}
+	parser.Parse([]string{"--color", "never"})
+	if executed := parser.LeftOversByCommand(); len(executed) != 1 || fmt.Sprint(executed[0].LeftOvers) != "[never]" {
+		t.Errorf("Following argument taken %v", executed)
+	}
+}
+
+func TestMetavar(t *testing.T) {
+	parser := NewParser("test")
+	output := parser.AddOption("output", "o", "", "", "", emptyFn)
+	if prefix := output.FlagStringPrefix(); prefix != "-o,--output OUTPUT" {
+		t.Errorf("Wrong prefix %v", prefix)
+	}
+	if prefix := output.Metavar("FILE").FlagStringPrefix(); prefix != "-o,--output FILE" {
+		t.Errorf("Wrong prefix %v", prefix)
+	}
+	ratio := parser.AddFloatOption("", "r", "", func(string, float64) error { return nil }).Metavar("N")
+	if prefix := ratio.FlagStringPrefix(); prefix != "-r N" {
+		t.Errorf("Wrong prefix %v", prefix)
+	}
+}
+
+func TestFlagPrefix(t *testing.T) {
+	values := map[string]string{}
+	fn := func(name, value string) error {
+		values[name] = value
+		return nil
+	}
+	var args []string
+	parser := NewParser("test")
+	parser.SetFlagPrefix("/", "/")
+	parser.AddSwitch("verbose", "v", "", fn)
+	parser.AddSwitch("quiet", "q", "", fn)
+	parser.AddOption("out", "o", "", "", "", fn)
+	parser.AddCommand("copy", "", "", func(name string, params ...string) error {
+		args = params
+		return nil
+	})
+	if _, err := parser.Parse([]string{"/verbose", "/q", "/out", "/tmp/file", "copy", "-x", "--y"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(values) != "map[out:/tmp/file quiet: verbose:]" || fmt.Sprint(args) != "[-x --y]" {
+		t.Errorf("Wrong values %v, arguments %v", values, args)
+	}
+	if _, err := parser.Parse([]string{"/verbos"}); err == nil || err.(UnknownFlagError).Flag != "/verbos" ||
+		err.(UnknownFlagError).Suggestion != "/verbose" {
+		t.Errorf("Wrong error %#v", err)
+	}
+	if _, err := parser.Parse([]string{"/out"}); err == nil || err.(MissingValueError).Flag != "/out" {
+		t.Errorf("Wrong error %#v", err)
+	}
+	//the value is checked against the flags as typed with the prefixes
+	if _, err := parser.Parse([]string{"/out", "/verbose"}); err == nil || err.(MissingValueError).Flag != "/out" {
+		t.Errorf("Wrong error %#v", err)
+	}
+	if _, err := parser.Parse([]string{"/o", "/v"}); err == nil || err.(MissingValueError).Flag != "/o" {
+		t.Errorf("Wrong error %#v", err)
+	}
+	values = map[string]string{}
+	if _, err := parser.Parse([]string{"/out", "-v"}); err != nil || values["out"] != "-v" {
+		t.Errorf("Wrong value %v %v", values, err)
+	}
+	parser.AllowUnknownFlags(true)
+	if _, err := parser.Parse([]string{"copy", "/unknown", "/verbose"}); err != nil || fmt.Sprint(args) != "[/unknown]" {
+		t.Errorf("The known flag was passed through %v %v", args, err)
+	}
+
+	values = map[string]string{}
+	parser = NewParser("test")
+	parser.SetFlagPrefix("++", "+")
+	parser.AddSwitch("verbose", "v", "", fn)
+	parser.AddSwitch("quiet", "q", "", fn)
+	parser.OnCommand(emptyFnMult)
+	if _, err := parser.Parse([]string{"++verbose", "+vq", "-5"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(values) != "map[quiet: verbose:]" {
+		t.Errorf("Wrong values %v", values)
+	}
+
+	//negative numbers are not flags with the default prefixes set either
+	parser = NewParser("test")
+	parser.SetFlagPrefix("--", "-")
+	parser.OnCommand(emptyFnMult)
+	if leftOvers, err := parser.Parse([]string{"-5"}); err != nil || fmt.Sprint(leftOvers) != "[-5]" {
+		t.Errorf("Wrong leftovers %v %v", leftOvers, err)
+	}
+}
+
+func TestValuesUntouched(t *testing.T) {
+	var values []string
+	parser := NewParser("test")
+	name := parser.AddOption(" name ", " n ", "", "", "", func(_, value string) error {
+		values = append(values, value)
+		return nil
+	})
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	for _, args := range [][]string{{"--name", " padded "}, {"--name= padded "}, {"-n", " padded "}, {"-n padded "}, {"-vn", " padded "}} {
+		values = nil
+		if _, err := parser.Parse(args); err != nil {
+			t.Errorf("Unexpected error %v for %q", err, args)
+		}
+		if len(values) != 1 || values[0] != " padded " || name.Value() != " padded " {
+			t.Errorf("Value altered %q for %q", values, args)
+		}
+	}
+	if name.Long != "name" || name.Short != "n" {
+		t.Errorf("Definitions not trimmed %q %q", name.Long, name.Short)
+	}
+}
+
+func TestFlagStringPrefix(t *testing.T) {
+	for _, c := range []struct {
+		flag     *Flag
+		expected string
+	}{
+		{buildFlag("option", "o", "", "", "", emptyFn, Option), "-o,--option OPTION"},
+		{buildFlag("option", "", "", "", "", emptyFn, Option), "   --option OPTION"},
+		{buildFlag("", "o", "", "", "", emptyFn, Option), "-o O"},
+		{buildFlag("option", "o", "", "", "FILE", emptyFn, Option), "-o,--option FILE"},
+		{buildFlag("switch", "s", "", "", "", emptyFn, Switch), "-s,--switch"},
+		{buildFlag("switch", "", "", "", "", emptyFn, Switch), "   --switch"},
+		{buildFlag("", "s", "", "", "", emptyFn, Switch), "-s"},
+	} {
+		if prefix := c.flag.FlagStringPrefix(); prefix != c.expected {
+			t.Errorf("Expected %q got %q", c.expected, prefix)
+		}
+		//mandatory and optional flags are rendered the same, the help marks the mandatory ones
+		if c.flag.Type == Option {
+			c.flag.Must(true)
+			if prefix := c.flag.FlagStringPrefix(); prefix != c.expected {
+				t.Errorf("Expected %q got %q for a mandatory flag", c.expected, prefix)
+			}
+		}
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	parser := NewParser("test")
+	names := []string{"zero", "one", "two", "three"}
+	for _, name := range names {
+		parser.AddCommand(name, "", "", emptyFnMult)
+	}
+	expected := []string{"one", "three", "two", "zero"}
+	commands := parser.CommandList()
+	if len(commands) != len(expected) {
+		t.Fatalf("Wrong number of commands %v", len(commands))
+	}
+	for idx, cmd := range commands {
+		if cmd.Name != expected[idx] {
+			t.Errorf("Commands are not sorted %v!=%v", expected[idx], cmd.Name)
+		}
+	}
+}
+
+func TestPreFlags(t *testing.T) {
+	parser := NewParser("test")
+	var calls []string
+	parser.PreFlags(func() error {
+		calls = append(calls, "pre")
+		return nil
+	})
+	parser.AddSwitch("switch", "s", "", func(string, string) error {
+		calls = append(calls, "switch")
+		return nil
+	})
+	_, err := parser.Parse([]string{"-s"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(calls, " ") != "pre switch" {
+		t.Errorf("Wrong call order %v", calls)
+	}
+}
+
+func TestPreFlagsError(t *testing.T) {
+	parser := NewParser("test")
+	called := false
+	cmd := parser.AddCommand("command", "", "", emptyFnMult)
+	cmd.PreFlags(func() error {
+		return errors.New("Error")
+	})
+	cmd.AddSwitch("switch", "s", "", func(string, string) error {
+		called = true
+		return nil
+	})
+	_, err := parser.Parse([]string{"command", "-s"})
+	if err == nil {
+		t.Error("Pre flags error not returned")
+	}
+	if called {
+		t.Error("Flag function called after a pre flags error")
+	}
+}
+
+func TestCommandPostFlags(t *testing.T) {
+	parser := NewParser("test")
+	var calls []string
+	cmd := parser.AddCommand("command", "", "", func(string, ...string) error {
+		calls = append(calls, "command")
+		return nil
+	})
+	cmd.AddSwitch("switch", "s", "", func(string, string) error {
+		calls = append(calls, "switch")
+		return nil
+	})
+	cmd.PostFlags(func() error {
+		calls = append(calls, "post")
+		return nil
+	})
+	_, err := parser.Parse([]string{"command", "-s"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if strings.Join(calls, " ") != "switch post command" {
+		t.Errorf("Wrong call order %v", calls)
+	}
+}
+
+func TestNegativeNumbers(t *testing.T) {
+	parser := NewParser("test")
+	var offset, ratio string
+	var lefts []string
+	parser.AddOption("offset", "o", "", "", "", func(name, val string) error {
+		offset = val
+		return nil
+	})
+	cmd := parser.AddCommand("command", "", "", func(command string, args ...string) error {
+		lefts = args
+		return nil
+	})
+	cmd.AddOption("ratio", "r", "", "", "", func(name, val string) error {
+		ratio = val
+		return nil
+	})
+	_, err := parser.Parse([]string{"--offset", "-5", "command", "-r", "-3.14", "-7"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if offset != "-5" || ratio != "-3.14" {
+		t.Errorf("Negative values not taken offset: %v ratio: %v", offset, ratio)
+	}
+	if len(lefts) != 1 || lefts[0] != "-7" {
+		t.Errorf("Negative number not taken as an argument %v", lefts)
+	}
+}
+
+func TestIsNegativeNumber(t *testing.T) {
+	for _, arg := range []string{"-5", "-3.14", "-.5", "-1e10"} {
+		if !isNegativeNumber(arg) {
+			t.Errorf("%v is a negative number", arg)
+		}
+	}
+	for _, arg := range []string{"-a", "--5", "-", "-5a", "-inf"} {
+		if isNegativeNumber(arg) {
+			t.Errorf("%v is not a negative number", arg)
+		}
+	}
+}
+
+func TestArityRange(t *testing.T) {
+	parser := NewParser("test")
+	parser.AddCommand("between", "", "", emptyFnMult).SetArityRange(2, 4, "src ... dst")
+	parser.AddCommand("least", "", "", emptyFnMult).SetArityRange(1, -1, "file ...")
+
+	for _, args := range [][]string{
+		{"between", "1", "2"},
+		{"between", "1", "2", "3", "4"},
+		{"least", "1"},
+		{"least", "1", "2", "3", "4", "5"},
+	} {
+		if _, err := parser.Parse(args); err != nil {
+			t.Errorf("Unexpected error %v for %v", err, args)
+		}
+	}
+	_, err := parser.Parse([]string{"between", "1"})
+	if err == nil || !strings.Contains(err.Error(), "accepts between 2 and 4 parameters but 1 found") {
+		t.Errorf("Wrong arity error %v", err)
+	}
+	_, err = parser.Parse([]string{"between", "1", "2", "3", "4", "5"})
+	if _, ok := err.(ArityError); !ok {
+		t.Errorf("Expected ArityError got %v", err)
+	}
+	_, err = parser.Parse([]string{"least"})
+	if err == nil || !strings.Contains(err.Error(), "accepts at least 1 parameters but 0 found") {
+		t.Errorf("Wrong arity error %v", err)
+	}
+}
+
+type ctxKey string
+
+func TestParseContext(t *testing.T) {
+	parser := NewParser("test")
+	ctx := context.WithValue(context.Background(), ctxKey("key"), "value")
+	var fromFlag, fromCommand, fromRoot interface{}
+	parser.OnCommandCtx(func(ctx context.Context, name string, args ...string) error {
+		fromRoot = ctx.Value(ctxKey("key"))
+		return nil
+	})
+	cmd := parser.AddCommandCtx("command", "", "", func(ctx context.Context, name string, args ...string) error {
+		fromCommand = ctx.Value(ctxKey("key"))
+		return nil
+	})
+	cmd.AddOptionCtx("option", "o", "", "", "", func(ctx context.Context, name, value string) error {
+		fromFlag = ctx.Value(ctxKey("key"))
+		return nil
+	})
+	_, err := parser.ParseContext(ctx, []string{"command", "-o", "val"})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if fromFlag != "value" || fromCommand != "value" || fromRoot != "value" {
+		t.Errorf("Context not passed flag: %v command: %v root: %v", fromFlag, fromCommand, fromRoot)
+	}
+}
+
+func TestParseContextCancelled(t *testing.T) {
+	parser := NewParser("test")
+	called := false
+	parser.AddCommand("command", "", "", func(string, ...string) error {
+		called = true
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := parser.ParseContext(ctx, []string{"command"})
+	if err != context.Canceled {
+		t.Errorf("Expected cancellation error got %v", err)
+	}
+	if called {
+		t.Error("Command executed after cancellation")
+	}
+}
+
+func TestParseOptionValueIsFlag(t *testing.T) {
+	parser := NewParser("test")
+	var output string
+	parser.AddOption("output", "o", "", "", "", func(name, val string) error {
+		output = val
+		return nil
+	})
+	parser.AddSwitch("verbose", "v", "", emptyFn)
+	parser.AddSwitch("quiet", "q", "", emptyFn)
+	for _, args := range [][]string{
+		{"--output", "--verbose"},
+		{"-o", "-v"},
+		{"-o", "-vq"},
+	} {
+		_, err := parser.Parse(args)
+		if e, ok := err.(MissingValueError); !ok || e.Flag != args[0] {
+			t.Errorf("Expected MissingValueError for %v got %v", args, err)
+		}
+	}
+	//unknown flags and negative numbers are values
+	for _, value := range []string{"-x", "-5", "-"} {
+		_, err := parser.Parse([]string{"--output", value})
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if output != value {
+			t.Errorf("Wrong value %v != %v", output, value)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package subcommand
+
+import "os"
+
+//Terminal detection is not supported in this platform
+func terminalColumns(f *os.File) int {
+	return 0
+}